@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Why a render was not admitted
+var (
+	errClientBusy = errors.New("too many pictures are being drawn for you at once, try again shortly")
+	errQueueFull  = errors.New("the server is drawing as much as it can and has too many waiting, try again later")
+	errWaitedLong = errors.New("the server was too busy to start drawing in time, try again later")
+)
+
+// A render waiting its turn
+type admissionWaiter struct {
+	cost     float64
+	admitted chan struct{}
+}
+
+// Limits the renders running at once to the -renders flag, and their estimated cost in
+// bytes to the -memory flag.  Renders over either limit wait in turn for up to the
+// -wait flag, with at most the -queue flag waiting, and no client may have more than
+// the -client-renders flag running or waiting.
+type Admission struct {
+	mu      sync.Mutex
+	renders int
+	cost    float64
+	clients map[string]int
+	queue   []*admissionWaiter
+}
+
+var (
+	admission = &Admission{clients: make(map[string]int)}
+)
+
+// Whether a render of the given cost can start now.  A render costing more than the
+// whole -memory flag may still run alone.
+func (a *Admission) fits(cost float64) bool {
+	return a.renders < *maxRenders && (a.renders == 0 || a.cost+cost <= *maxMemory)
+}
+
+func (a *Admission) start(cost float64) {
+	a.renders++
+	a.cost += cost
+}
+
+// Start the waiting renders that now fit, in the order they arrived
+func (a *Admission) dispatch() {
+	for len(a.queue) > 0 && a.fits(a.queue[0].cost) {
+		waiter := a.queue[0]
+		a.queue = a.queue[1:]
+		a.start(waiter.cost)
+		close(waiter.admitted)
+	}
+}
+
+// Wait for the client's render of the given cost to be admitted, returning the
+// function to call once it is drawn, or why it was not admitted
+func (a *Admission) Acquire(ctx context.Context, client string, cost float64) (func(), error) {
+	a.mu.Lock()
+	if a.clients[client] >= *maxClientRenders {
+		a.mu.Unlock()
+		return nil, errClientBusy
+	}
+	release := func() {
+		a.mu.Lock()
+		a.finish(client, cost)
+		a.mu.Unlock()
+	}
+	if len(a.queue) == 0 && a.fits(cost) {
+		a.start(cost)
+		a.clients[client]++
+		a.mu.Unlock()
+		return release, nil
+	}
+	if len(a.queue) >= *maxQueue {
+		a.mu.Unlock()
+		return nil, errQueueFull
+	}
+	waiter := &admissionWaiter{cost: cost, admitted: make(chan struct{})}
+	a.queue = append(a.queue, waiter)
+	a.clients[client]++
+	a.mu.Unlock()
+
+	timer := time.NewTimer(*maxWait)
+	defer timer.Stop()
+	var err error
+	select {
+	case <-waiter.admitted:
+		return release, nil
+	case <-timer.C:
+		err = errWaitedLong
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for i, w := range a.queue {
+		if w == waiter {
+			a.queue = append(a.queue[:i], a.queue[i+1:]...)
+			a.leave(client)
+			// the renders behind it may fit where it did not
+			a.dispatch()
+			return nil, err
+		}
+	}
+	// it was admitted as it gave up waiting
+	return release, nil
+}
+
+// Finish the client's render of the given cost, starting the waiting ones that now fit
+func (a *Admission) finish(client string, cost float64) {
+	a.renders--
+	a.cost -= cost
+	a.leave(client)
+	a.dispatch()
+}
+
+func (a *Admission) leave(client string) {
+	a.clients[client]--
+	if a.clients[client] <= 0 {
+		delete(a.clients, client)
+	}
+}
+
+// Return the address a request came from, without its port
+func clientOf(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// Wait for a render costing the given estimate to be admitted, returning the function
+// to call once it is drawn.  If it is not admitted the response asking the client to
+// try again later is written and nil returned.
+func admit(w http.ResponseWriter, req *http.Request, e Estimate) func() {
+	release, err := admission.Acquire(req.Context(), clientOf(req), e.Bytes)
+	if err == nil {
+		return release
+	}
+
+	var status int
+	var retry time.Duration
+	switch err {
+	case errClientBusy:
+		status, retry = http.StatusTooManyRequests, time.Second
+	case errQueueFull, errWaitedLong:
+		status, retry = http.StatusServiceUnavailable, *maxWait
+	default:
+		// the client went away while waiting
+		return nil
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retry.Seconds()))))
+	writeJSONErrors(w, status, []FieldError{{Message: err.Error()}})
+	return nil
+}
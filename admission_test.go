@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Set the admission limits and start with nothing running, putting both back once the
+// test is done
+func setLimits(t *testing.T, renders, clientRenders, queue int, wait time.Duration, memory float64) *Admission {
+	old := []interface{}{*maxRenders, *maxClientRenders, *maxQueue, *maxWait, *maxMemory, admission}
+	t.Cleanup(func() {
+		*maxRenders, *maxClientRenders, *maxQueue = old[0].(int), old[1].(int), old[2].(int)
+		*maxWait, *maxMemory, admission = old[3].(time.Duration), old[4].(float64), old[5].(*Admission)
+	})
+	*maxRenders, *maxClientRenders, *maxQueue, *maxWait, *maxMemory = renders, clientRenders, queue, wait, memory
+	admission = &Admission{clients: make(map[string]int)}
+	return admission
+}
+
+// Wait until n renders are waiting
+func waitForQueue(t *testing.T, a *Admission, n int) {
+	for start := time.Now(); time.Since(start) < time.Second; time.Sleep(time.Millisecond) {
+		a.mu.Lock()
+		queued := len(a.queue)
+		a.mu.Unlock()
+		if queued == n {
+			return
+		}
+	}
+	t.Fatalf("%d renders never came to be waiting", n)
+}
+
+// Check that nothing is left running or waiting
+func checkIdle(t *testing.T, a *Admission) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.renders != 0 || a.cost != 0 || len(a.clients) != 0 || len(a.queue) != 0 {
+		t.Errorf("left %d renders costing %g running, clients %v and %d waiting", a.renders, a.cost, a.clients, len(a.queue))
+	}
+}
+
+func TestAdmit(t *testing.T) {
+	type running struct {
+		client string
+		cost   float64
+	}
+	for _, c := range []struct {
+		name                          string
+		renders, clientRenders, queue int
+		wait                          time.Duration
+		memory                        float64
+		running                       []running
+		client                        string
+		cost                          float64
+		status                        int // 0 if it is admitted
+		retryAfter                    string
+	}{
+		{name: "idle", renders: 1, clientRenders: 1, queue: 1, wait: time.Second, memory: 100,
+			client: "a", cost: 10},
+		{name: "too big for memory but alone", renders: 2, clientRenders: 2, queue: 1, wait: time.Second, memory: 100,
+			client: "a", cost: 1000},
+		{name: "room for another", renders: 2, clientRenders: 2, queue: 1, wait: time.Second, memory: 100,
+			running: []running{{"a", 50}}, client: "a", cost: 50},
+		{name: "client busy", renders: 4, clientRenders: 1, queue: 4, wait: time.Second, memory: 100,
+			running: []running{{"a", 1}}, client: "a", cost: 1, status: 429, retryAfter: "1"},
+		{name: "queue full", renders: 1, clientRenders: 4, queue: 0, wait: 2500 * time.Millisecond, memory: 100,
+			running: []running{{"a", 1}}, client: "b", cost: 1, status: 503, retryAfter: "3"},
+		{name: "waited too long for a render", renders: 1, clientRenders: 4, queue: 4, wait: 20 * time.Millisecond, memory: 100,
+			running: []running{{"a", 1}}, client: "b", cost: 1, status: 503, retryAfter: "1"},
+		{name: "waited too long for memory", renders: 4, clientRenders: 4, queue: 4, wait: 20 * time.Millisecond, memory: 100,
+			running: []running{{"a", 80}}, client: "b", cost: 30, status: 503, retryAfter: "1"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			a := setLimits(t, c.renders, c.clientRenders, c.queue, c.wait, c.memory)
+			var releases []func()
+			for _, r := range c.running {
+				release, err := a.Acquire(context.Background(), r.client, r.cost)
+				if err != nil {
+					t.Fatalf("a render for %s costing %g was not admitted: %v", r.client, r.cost, err)
+				}
+				releases = append(releases, release)
+			}
+
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = c.client + ":1234"
+			w := httptest.NewRecorder()
+			release := admit(w, req, Estimate{Bytes: c.cost})
+			if c.status == 0 {
+				if release == nil {
+					t.Fatalf("not admitted, answered %d: %s", w.Code, w.Body)
+				}
+				releases = append(releases, release)
+			} else {
+				if release != nil {
+					t.Fatalf("admitted rather than answered %d", c.status)
+				}
+				if w.Code != c.status || w.Header().Get("Retry-After") != c.retryAfter {
+					t.Errorf("answered %d with Retry-After %q, expected %d with %q", w.Code, w.Header().Get("Retry-After"), c.status, c.retryAfter)
+				}
+			}
+			for _, release := range releases {
+				release()
+			}
+			checkIdle(t, a)
+		})
+	}
+}
+
+func TestAdmissionIsFirstInFirstOut(t *testing.T) {
+	a := setLimits(t, 1, 4, 8, time.Second, 100)
+	release, _ := a.Acquire(context.Background(), "first", 1)
+
+	const waiting = 6
+	order := make(chan int, waiting)
+	done := make(chan bool)
+	for i := 0; i < waiting; i++ {
+		go func(i int) {
+			// a cheap render behind a dear one still waits its turn
+			cost := 1.0
+			if i == 0 {
+				cost = 100
+			}
+			release, err := a.Acquire(context.Background(), string(rune('a'+i%3)), cost)
+			if err != nil {
+				t.Errorf("render %d was not admitted: %v", i, err)
+				order <- -1
+			} else {
+				order <- i
+				release()
+			}
+			done <- true
+		}(i)
+		waitForQueue(t, a, i+1)
+	}
+	release()
+	for i := 0; i < waiting; i++ {
+		if got := <-order; got != i {
+			t.Errorf("render %d was admitted as number %d", got, i)
+		}
+		<-done
+	}
+	checkIdle(t, a)
+}
+
+func TestClientRendersCountWhileWaiting(t *testing.T) {
+	a := setLimits(t, 1, 2, 8, time.Second, 100)
+	release, _ := a.Acquire(context.Background(), "a", 1)
+
+	admitted := make(chan func())
+	go func() {
+		waiting, err := a.Acquire(context.Background(), "a", 1)
+		if err != nil {
+			t.Errorf("the waiting render was not admitted: %v", err)
+		}
+		admitted <- waiting
+	}()
+	waitForQueue(t, a, 1)
+	if _, err := a.Acquire(context.Background(), "a", 1); err != errClientBusy {
+		t.Errorf("a third render for the client gave %v", err)
+	}
+
+	release()
+	waiting := <-admitted
+	a.mu.Lock()
+	if a.renders != 1 || a.clients["a"] != 1 {
+		t.Errorf("with the waiting render admitted %d are running, %d for its client", a.renders, a.clients["a"])
+	}
+	a.mu.Unlock()
+	waiting()
+	checkIdle(t, a)
+}
+
+func TestGivingUpAsAdmitted(t *testing.T) {
+	a := setLimits(t, 1, 4, 8, time.Second, 100)
+	if _, err := a.Acquire(context.Background(), "a", 1); err != nil {
+		t.Fatalf("the first render was not admitted: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error)
+	var waiting func()
+	go func() {
+		var err error
+		waiting, err = a.Acquire(ctx, "b", 1)
+		result <- err
+	}()
+	waitForQueue(t, a, 1)
+
+	// the waiter gives up, but the first render finishes and admits it before the
+	// waiter can take itself off the queue
+	a.mu.Lock()
+	cancel()
+	time.Sleep(20 * time.Millisecond)
+	a.finish("a", 1)
+	a.mu.Unlock()
+
+	if err := <-result; err != nil {
+		t.Fatalf("the admitted render gave %v", err)
+	}
+	a.mu.Lock()
+	if a.renders != 1 || a.clients["b"] != 1 {
+		t.Errorf("with the render admitted %d are running, %d for its client", a.renders, a.clients["b"])
+	}
+	a.mu.Unlock()
+	waiting()
+	checkIdle(t, a)
+}
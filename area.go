@@ -0,0 +1,161 @@
+package main
+
+import (
+	"github.com/ajstarks/svgo"
+	"math"
+	"net/http"
+)
+
+// Upper bound on the number of polygons an area fractal may draw
+const maxAreaPolygons = 1 << 17
+
+// A fractal built by repeatedly replacing a polygon with smaller polygons
+type AreaFractal struct {
+	Initiator         []Point // in the unit square, with y pointing down the canvas
+	Subdivide         func(polygon []Point) [][]Point
+	Pieces            int // the number of polygons each polygon is replaced with
+	DefaultComplexity int
+}
+
+var (
+	sierpinskiTriangle = &AreaFractal{
+		Initiator:         []Point{{X: 0.5, Y: 0.5 - math.Sqrt(3.0)/4.0}, {X: 1.0, Y: 0.5 + math.Sqrt(3.0)/4.0}, {X: 0.0, Y: 0.5 + math.Sqrt(3.0)/4.0}},
+		Subdivide:         subdivideTriangle,
+		Pieces:            3,
+		DefaultComplexity: 6,
+	}
+	sierpinskiCarpet = &AreaFractal{
+		Initiator:         []Point{{X: 0.0, Y: 0.0}, {X: 1.0, Y: 0.0}, {X: 1.0, Y: 1.0}, {X: 0.0, Y: 1.0}},
+		Subdivide:         subdivideCarpet,
+		Pieces:            8,
+		DefaultComplexity: 4,
+	}
+	vicsekCross = &AreaFractal{
+		Initiator:         []Point{{X: 0.0, Y: 0.0}, {X: 1.0, Y: 0.0}, {X: 1.0, Y: 1.0}, {X: 0.0, Y: 1.0}},
+		Subdivide:         subdivideVicsekCross,
+		Pieces:            5,
+		DefaultComplexity: 5,
+	}
+	vicsekSaltire = &AreaFractal{
+		Initiator:         []Point{{X: 0.0, Y: 0.0}, {X: 1.0, Y: 0.0}, {X: 1.0, Y: 1.0}, {X: 0.0, Y: 1.0}},
+		Subdivide:         subdivideVicsekSaltire,
+		Pieces:            5,
+		DefaultComplexity: 5,
+	}
+	sierpinskiArrowhead = &SpaceFillingCurve{Init: (*LSystem).InitArrowhead, Angle: math.Pi / 3.0, Draw: "AB", DefaultComplexity: 6, MaxComplexity: depthLimit(3, maxAreaPolygons)}
+)
+
+// Return the deepest recursion that keeps pieces^depth within maxCount
+func depthLimit(pieces, maxCount int) int {
+	if pieces < 2 {
+		return maxCount
+	}
+	depth := 0
+	for count := pieces; count <= maxCount; count *= pieces {
+		depth++
+	}
+	return depth
+}
+
+// Return the point at (u, v) across the parallelogram with corners p[0], p[1], p[3]
+func gridPoint(p []Point, u, v float64) Point {
+	return Point{X: p[0].X + u*(p[1].X-p[0].X) + v*(p[3].X-p[0].X), Y: p[0].Y + u*(p[1].Y-p[0].Y) + v*(p[3].Y-p[0].Y)}
+}
+
+// Return the cell (i, j) of an n x n grid laid over the parallelogram p
+func gridCell(p []Point, i, j, n int) []Point {
+	step := 1.0 / float64(n)
+	u, v := float64(i)*step, float64(j)*step
+	return []Point{gridPoint(p, u, v), gridPoint(p, u+step, v), gridPoint(p, u+step, v+step), gridPoint(p, u, v+step)}
+}
+
+// Replace a triangle with the three corner triangles formed by the midpoints of its edges
+func subdivideTriangle(p []Point) [][]Point {
+	ab := NewLine3(p[0], p[1]).At(0.5)
+	bc := NewLine3(p[1], p[2]).At(0.5)
+	ca := NewLine3(p[2], p[0]).At(0.5)
+	return [][]Point{{p[0], ab, ca}, {ab, p[1], bc}, {ca, bc, p[2]}}
+}
+
+// Replace a square with the eight outer squares of a 3x3 grid
+func subdivideCarpet(p []Point) [][]Point {
+	pieces := make([][]Point, 0, 8)
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			if i != 1 || j != 1 {
+				pieces = append(pieces, gridCell(p, i, j, 3))
+			}
+		}
+	}
+	return pieces
+}
+
+// Replace a square with the centre and edge squares of a 3x3 grid
+func subdivideVicsekCross(p []Point) [][]Point {
+	return [][]Point{gridCell(p, 1, 1, 3), gridCell(p, 1, 0, 3), gridCell(p, 0, 1, 3), gridCell(p, 2, 1, 3), gridCell(p, 1, 2, 3)}
+}
+
+// Replace a square with the centre and corner squares of a 3x3 grid
+func subdivideVicsekSaltire(p []Point) [][]Point {
+	return [][]Point{gridCell(p, 1, 1, 3), gridCell(p, 0, 0, 3), gridCell(p, 2, 0, 3), gridCell(p, 0, 2, 3), gridCell(p, 2, 2, 3)}
+}
+
+// Draw a filled polygon
+func renderPolygon(s *svg.SVG, polygon []Point, style string) {
+	x := make([]int, len(polygon))
+	y := make([]int, len(polygon))
+	for i, p := range polygon {
+		x[i], y[i] = int(p.X), int(p.Y)
+	}
+	s.Polygon(x, y, style)
+}
+
+// Do the fractal
+func doAreaFractal(s *svg.SVG, fractal *AreaFractal, polygon []Point, depth int) {
+	if depth <= 0 {
+		renderPolygon(s, polygon, "fill:black;stroke:none")
+		return
+	}
+	for _, piece := range fractal.Subdivide(polygon) {
+		doAreaFractal(s, fractal, piece, depth-1)
+	}
+}
+
+// Draw the fractal, placing its unit square initiator on the canvas with view
+func areaFractal(s *svg.SVG, fractal *AreaFractal, complexity int, view *Matrix) {
+	polygon := make([]Point, len(fractal.Initiator))
+	for i, p := range fractal.Initiator {
+		polygon[i] = view.Apply(p)
+	}
+	doAreaFractal(s, fractal, polygon, complexity)
+}
+
+// Create a handler drawing the given area fractal
+func areaHandler(fractal *AreaFractal) RenderFunc {
+	return func(w http.ResponseWriter, req *http.Request, v Values) {
+		const (
+			size   = 1000
+			margin = 20
+		)
+
+		complexity := v.Int("complexity")
+
+		view := NewMatrix()
+		view.Translate(margin, margin)
+		view.Scale(size-2*margin, size-2*margin)
+
+		w.Header().Set("Content-Type", "image/svg+xml")
+		s := svg.New(w)
+		s.Start(size, size)
+		defer s.End()
+
+		areaFractal(s, fractal, complexity, view)
+	}
+}
+
+// Create the estimate for drawing the given area fractal
+func areaEstimate(fractal *AreaFractal) EstimateFunc {
+	return func(v Values) Estimate {
+		return polygonEstimate(powerOf(fractal.Pieces, v.Int("complexity")), len(fractal.Initiator))
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"io"
+	"net/http"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Renders larger than this are never cached
+const maxCachedRender = 32 << 20
+
+// The response headers kept along with a cached render
+var cachedHeaders = []string{"Content-Type", "Content-Encoding", "Content-Disposition"}
+
+// A finished picture, named by the hash of the fractal and parameters drawing it
+type cachedRender struct {
+	key    string
+	header http.Header
+	body   []byte
+}
+
+// The renders most recently used, up to the -cache flag bytes between them, in front of
+// every render written to the -cache-dir directory, if it is set
+type RenderCache struct {
+	mu      sync.Mutex
+	size    int
+	order   *list.List // of *cachedRender, the most recently used first
+	entries map[string]*list.Element
+}
+
+var (
+	renderCache = &RenderCache{order: list.New(), entries: make(map[string]*list.Element)}
+)
+
+// Return the file keeping a render on disk
+func cacheFile(key string) string {
+	return filepath.Join(*cacheDir, key[:2], key)
+}
+
+// Return the render with the given key, or nil if it is not cached
+func (c *RenderCache) Get(key string) *cachedRender {
+	c.mu.Lock()
+	if e, ok := c.entries[key]; ok {
+		c.order.MoveToFront(e)
+		c.mu.Unlock()
+		return e.Value.(*cachedRender)
+	}
+	c.mu.Unlock()
+
+	if *cacheDir == "" {
+		return nil
+	}
+	// on disk the headers come first, as they would in a response
+	data, err := os.ReadFile(cacheFile(key))
+	if err != nil {
+		return nil
+	}
+	reader := bufio.NewReader(bytes.NewReader(data))
+	header, err := textproto.NewReader(reader).ReadMIMEHeader()
+	if err != nil {
+		return nil
+	}
+	body, _ := io.ReadAll(reader)
+	r := &cachedRender{key: key, header: http.Header(header), body: body}
+	c.remember(r)
+	return r
+}
+
+// Cache a render
+func (c *RenderCache) Put(r *cachedRender) {
+	c.remember(r)
+	if *cacheDir != "" {
+		var data bytes.Buffer
+		r.header.Write(&data)
+		data.WriteString("\r\n")
+		data.Write(r.body)
+		// a render that can't be kept on disk is still kept in memory
+		_ = writeFileAtomic(cacheFile(r.key), data.Bytes())
+	}
+}
+
+// Keep a render in memory, forgetting the least recently used to make room
+func (c *RenderCache) remember(r *cachedRender) {
+	if int64(len(r.body)) > *cacheSize {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[r.key]; ok {
+		return
+	}
+	c.entries[r.key] = c.order.PushFront(r)
+	c.size += len(r.body)
+	for int64(c.size) > *cacheSize {
+		oldest := c.order.Remove(c.order.Back()).(*cachedRender)
+		delete(c.entries, oldest.key)
+		c.size -= len(oldest.body)
+	}
+}
+
+// Passes a response on while keeping a copy of it for the cache, unless it grows
+// larger than maxCachedRender.  A render that would not draw the same picture again,
+// such as one cut short by a time limit, sets Cache-Control: no-store to not be cached.
+type recordingResponse struct {
+	http.ResponseWriter
+	status    int
+	cacheable bool
+	header    http.Header // the cached headers as the render set them
+	body      bytes.Buffer
+	overflow  bool
+}
+
+func (r *recordingResponse) WriteHeader(status int) {
+	r.status = status
+	// taken before the call goes on, as a gzipped response then adds its own encoding
+	// to the same headers, which the body recorded here doesn't have
+	r.header = http.Header{}
+	for _, name := range cachedHeaders {
+		if value := r.Header().Get(name); value != "" {
+			r.header.Set(name, value)
+		}
+	}
+	r.cacheable = status == http.StatusOK && r.Header().Get("Cache-Control") != "no-store"
+	if !r.cacheable {
+		// only a finished picture may be cached by the client
+		r.Header().Del("ETag")
+		if status != http.StatusOK {
+			r.Header().Del("Cache-Control")
+		}
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *recordingResponse) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.WriteHeader(http.StatusOK)
+	}
+	if !r.overflow {
+		if r.body.Len()+len(b) > maxCachedRender {
+			r.overflow = true
+			r.body = bytes.Buffer{}
+		} else {
+			r.body.Write(b)
+		}
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+// Send on what has been written so far, so a picture can be streamed as it is drawn
+func (r *recordingResponse) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Whether an If-None-Match header lists the etag
+func etagMatches(header, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == etag || tag == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// Serve the render with the given key from the cache, or draw it with render and cache
+// it if it is finished.  A client that already has it is told so without it being drawn.
+func serveCached(w http.ResponseWriter, req *http.Request, key string, render func(w http.ResponseWriter) error) {
+	etag := `"` + key + `"`
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	if etagMatches(req.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	if r := renderCache.Get(key); r != nil {
+		for name, values := range r.header {
+			w.Header()[name] = values
+		}
+		w.Write(r.body)
+		return
+	}
+
+	rec := &recordingResponse{ResponseWriter: w}
+	if err := render(rec); err != nil {
+		// the picture was cut short, and must not be mistaken for a finished one
+		panic(http.ErrAbortHandler)
+	}
+	if rec.cacheable && !rec.overflow {
+		renderCache.Put(&cachedRender{key: key, header: rec.header, body: rec.body.Bytes()})
+	}
+}
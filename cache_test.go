@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Fetch a url from the server as it is set up in main, asking for gzip if it is given
+func fetch(t *testing.T, url, acceptEncoding string) (*httptest.ResponseRecorder, []byte) {
+	req := httptest.NewRequest("GET", url, nil)
+	if acceptEncoding != "" {
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+	}
+	w := httptest.NewRecorder()
+	gzipHandler(findFractal("koch-curve")).ServeHTTP(w, req)
+	body := w.Body.Bytes()
+	if w.Header().Get("Content-Encoding") == "gzip" {
+		r, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("%s: the body is not gzipped: %v", url, err)
+		}
+		if body, err = io.ReadAll(r); err != nil {
+			t.Fatalf("%s: the gzipped body is cut short: %v", url, err)
+		}
+	}
+	return w, body
+}
+
+func TestCachedRenderWithAndWithoutGzip(t *testing.T) {
+	const url = "/linear/koch/curve/?complexity=3&pi=0.25"
+
+	first, picture := fetch(t, url, "gzip")
+	if first.Code != 200 || first.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("the first fetch gave %d with encoding %q", first.Code, first.Header().Get("Content-Encoding"))
+	}
+	for _, c := range []struct {
+		acceptEncoding, contentEncoding string
+	}{
+		{"", ""},
+		{"gzip", "gzip"},
+		{"", ""},
+	} {
+		w, body := fetch(t, url, c.acceptEncoding)
+		if encoding := w.Header().Get("Content-Encoding"); encoding != c.contentEncoding {
+			t.Errorf("asking for %q gave the cached render encoded as %q", c.acceptEncoding, encoding)
+		}
+		if !bytes.Equal(body, picture) {
+			t.Errorf("asking for %q gave a cached render differing from the one drawn", c.acceptEncoding)
+		}
+	}
+}
+
+func TestCachedSVGZ(t *testing.T) {
+	const url = "/linear/koch/curve/?complexity=3&pi=0.3&format=svgz"
+
+	for _, acceptEncoding := range []string{"", "gzip", ""} {
+		w, body := fetch(t, url, acceptEncoding)
+		if w.Header().Get("Content-Encoding") != "gzip" || w.Header().Get("Content-Disposition") == "" {
+			t.Errorf("asking for %q gave headers %v", acceptEncoding, w.Header())
+		}
+		if !bytes.HasPrefix(body, []byte("<?xml")) {
+			t.Errorf("asking for %q gave a body not gzipped exactly once", acceptEncoding)
+		}
+	}
+}
+
+func TestUnfinishedDLAIsNotCached(t *testing.T) {
+	f := findFractal("dla")
+	for _, c := range []struct {
+		query  string
+		cached bool
+	}{
+		{"particles=50000&budget=0.1&seed=7", false},
+		{"particles=20&seed=7", true},
+	} {
+		req := httptest.NewRequest("GET", f.Path+"?"+c.query, nil)
+		v, _ := f.Parse(req)
+		w := httptest.NewRecorder()
+		f.ServeHTTP(w, req)
+		if w.Code != 200 {
+			t.Fatalf("%s: answered %d", c.query, w.Code)
+		}
+		if cached := renderCache.Get(v.Hash()) != nil; cached != c.cached {
+			t.Errorf("%s: cached was %v", c.query, cached)
+		}
+		if etag := w.Header().Get("ETag") != ""; etag != c.cached {
+			t.Errorf("%s: sent with headers %v", c.query, w.Header())
+		}
+	}
+}
+
+func TestRecordingResponseFlushesGzip(t *testing.T) {
+	w := httptest.NewRecorder()
+	g := &gzipResponse{ResponseWriter: w}
+	rec := &recordingResponse{ResponseWriter: g}
+	rec.Header().Set("Content-Type", "image/svg+xml")
+	rec.Write([]byte("<?xml version=\"1.0\"?>\n<svg>"))
+
+	flusher, ok := interface{}(rec).(http.Flusher)
+	if !ok {
+		t.Fatalf("a recorded response can't be flushed")
+	}
+	flusher.Flush()
+	if !w.Flushed {
+		t.Errorf("flushing the recorded response did not reach the client")
+	}
+	// what was flushed is enough to unzip what was written so far
+	r, err := gzip.NewReader(bytes.NewReader(w.Body.Bytes()))
+	if err != nil {
+		t.Fatalf("the flushed body is not gzipped: %v", err)
+	}
+	got := make([]byte, 100)
+	n, _ := io.ReadAtLeast(r, got, 27)
+	if string(got[:n]) != "<?xml version=\"1.0\"?>\n<svg>" {
+		t.Errorf("the flushed body unzips to %q", got[:n])
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"errors"
+	"github.com/ajstarks/svgo"
+	"math"
+	"math/cmplx"
+	"net/http"
+)
+
+// Upper bound on the number of circles a circle packing may draw
+const maxCircles = 1 << 17
+
+// A circle, described by its signed curvature and centre.  An enclosing
+// circle has a negative curvature.
+type Circle struct {
+	Curvature float64
+	Center    complex128
+}
+
+// The radius of the circle
+func (c Circle) Radius() float64 {
+	return math.Abs(1.0 / c.Curvature)
+}
+
+// draw a circle
+func (c Circle) Render(s *svg.SVG, view *Matrix) {
+	p := view.Apply(Point{X: real(c.Center), Y: imag(c.Center)})
+	r := c.Radius() * math.Sqrt(math.Abs(view.Determinant()))
+	s.Circle(int(p.X), int(p.Y), int(math.Max(1.0, r)), "fill:none;stroke:black")
+}
+
+// Return the circle tangent to a, b and c other than d, using Descartes' circle theorem
+func otherTangentCircle(a, b, c, d Circle) Circle {
+	k := 2.0*(a.Curvature+b.Curvature+c.Curvature) - d.Curvature
+	kz := 2.0*(complex(a.Curvature, 0)*a.Center+complex(b.Curvature, 0)*b.Center+complex(c.Curvature, 0)*c.Center) - complex(d.Curvature, 0)*d.Center
+	return Circle{Curvature: k, Center: kz / complex(k, 0)}
+}
+
+// Place three mutually tangent circles with the given curvatures, and find the
+// circle enclosing them
+func apollonianStart(k1, k2, k3 float64) ([4]Circle, error) {
+	var circles [4]Circle
+	if k1 <= 0.0 || k2 <= 0.0 || k3 <= 0.0 {
+		return circles, errors.New("curvatures must be positive")
+	}
+	r1, r2, r3 := 1.0/k1, 1.0/k2, 1.0/k3
+
+	// the centres form a triangle with sides r1+r2, r1+r3 and r2+r3
+	a, b, c := r1+r2, r1+r3, r2+r3
+	x := (a*a + b*b - c*c) / (2.0 * a)
+	y := math.Sqrt(math.Max(0.0, b*b-x*x))
+	circles[0] = Circle{Curvature: k1, Center: 0}
+	circles[1] = Circle{Curvature: k2, Center: complex(a, 0)}
+	circles[2] = Circle{Curvature: k3, Center: complex(x, y)}
+
+	k4 := k1 + k2 + k3 - 2.0*math.Sqrt(k1*k2+k2*k3+k3*k1)
+	if k4 >= 0.0 {
+		return circles, errors.New("the circles must be enclosed by a fourth circle")
+	}
+
+	// pick whichever solution for the centre is tangent to the first circle
+	sum := complex(k1, 0)*circles[0].Center + complex(k2, 0)*circles[1].Center + complex(k3, 0)*circles[2].Center
+	root := 2.0 * cmplx.Sqrt(complex(k1*k2, 0)*circles[0].Center*circles[1].Center+
+		complex(k2*k3, 0)*circles[1].Center*circles[2].Center+
+		complex(k1*k3, 0)*circles[0].Center*circles[2].Center)
+	best := math.Inf(1)
+	for _, z := range []complex128{(sum + root) / complex(k4, 0), (sum - root) / complex(k4, 0)} {
+		miss := math.Abs(cmplx.Abs(z-circles[0].Center) - (-1.0/k4 - r1))
+		if miss < best {
+			best = miss
+			circles[3] = Circle{Curvature: k4, Center: z}
+		}
+	}
+	return circles, nil
+}
+
+// Do the fractal, add the circle tangent to a, b and c other than d, then fill the
+// three gaps around it
+func doApollonianGasket(circles []Circle, a, b, c, d Circle, minRadius float64) []Circle {
+	next := otherTangentCircle(a, b, c, d)
+	if next.Curvature <= 0.0 || next.Radius() < minRadius || len(circles) >= maxCircles {
+		return circles
+	}
+	circles = append(circles, next)
+	circles = doApollonianGasket(circles, a, b, next, c, minRadius)
+	circles = doApollonianGasket(circles, a, c, next, b, minRadius)
+	return doApollonianGasket(circles, b, c, next, a, minRadius)
+}
+
+// Build the gasket from three starting curvatures, stopping at circles smaller than
+// minRadius (as a fraction of the enclosing circle's radius)
+func apollonianGasket(k1, k2, k3, minRadius float64) ([]Circle, error) {
+	start, err := apollonianStart(k1, k2, k3)
+	if err != nil {
+		return nil, err
+	}
+	minRadius *= start[3].Radius()
+
+	circles := start[:]
+	circles = doApollonianGasket(circles, start[0], start[1], start[2], start[3], minRadius)
+	circles = doApollonianGasket(circles, start[0], start[1], start[3], start[2], minRadius)
+	circles = doApollonianGasket(circles, start[0], start[2], start[3], start[1], minRadius)
+	circles = doApollonianGasket(circles, start[1], start[2], start[3], start[0], minRadius)
+	return circles, nil
+}
+
+// Build a Pappus chain in the arbelos formed by a circle of diameter 1 and two
+// circles of diameters ratio and 1-ratio, stopping at circles smaller than minRadius
+func pappusChain(ratio, minRadius float64) []Circle {
+	circles := []Circle{
+		{Curvature: -2.0, Center: complex(0.5, 0)},
+		{Curvature: 2.0 / ratio, Center: complex(ratio/2.0, 0)},
+	}
+	for n := 0; len(circles) < maxCircles; n++ {
+		d := float64(n*n)*(1.0-ratio)*(1.0-ratio) + ratio
+		r := ratio * (1.0 - ratio) / (2.0 * d)
+		if r < minRadius {
+			break
+		}
+		x := ratio * (1.0 + ratio) / (2.0 * d)
+		y := float64(n) * ratio * (1.0 - ratio) / d
+		circles = append(circles, Circle{Curvature: 1.0 / r, Center: complex(x, y)})
+		if n > 0 {
+			circles = append(circles, Circle{Curvature: 1.0 / r, Center: complex(x, -y)})
+		}
+	}
+	return circles
+}
+
+// Draw the circles, placing the first (enclosing) circle in the middle of the canvas
+func renderCircles(s *svg.SVG, circles []Circle, size, margin int) {
+	outer := circles[0]
+	for _, c := range circles {
+		if c.Curvature < 0.0 {
+			outer = c
+		}
+	}
+	r := outer.Radius()
+	low := Point{X: real(outer.Center) - r, Y: imag(outer.Center) - r}
+	high := Point{X: real(outer.Center) + r, Y: imag(outer.Center) + r}
+	view := NewFitMatrix(low, high, float64(size), float64(margin))
+
+	for _, c := range circles {
+		c.Render(s, view)
+	}
+}
+
+func apollonianHandler(w http.ResponseWriter, req *http.Request, v Values) {
+	const (
+		size   = 1000
+		margin = 20
+	)
+
+	circles, err := apollonianGasket(v.Float("k1"), v.Float("k2"), v.Float("k3"), v.Float("min"))
+	if err != nil {
+		paramError(w, "k1", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/svg+xml")
+	s := svg.New(w)
+	s.Start(size, size)
+	defer s.End()
+
+	renderCircles(s, circles, size, margin)
+}
+
+func pappusHandler(w http.ResponseWriter, req *http.Request, v Values) {
+	const (
+		size   = 1000
+		margin = 20
+	)
+
+	// the enclosing circle has a radius of 0.5
+	circles := pappusChain(v.Float("ratio"), v.Float("min")*0.5)
+
+	w.Header().Set("Content-Type", "image/svg+xml")
+	s := svg.New(w)
+	s.Start(size, size)
+	defer s.End()
+
+	renderCircles(s, circles, size, margin)
+}
+
+// The number of circles in a gasket larger than a fraction r of the enclosing circle
+// grows as r^-apollonianDimension
+const (
+	apollonianDimension = 1.3057
+	apollonianCircles   = 0.4
+)
+
+func apollonianEstimate(v Values) Estimate {
+	circles := apollonianCircles * math.Pow(v.Float("min"), -apollonianDimension)
+	return circleEstimate(math.Min(circles, maxCircles))
+}
+
+// The chain holds the circles whose radius is at least min, so its exact size is known
+func pappusEstimate(v Values) Estimate {
+	ratio, minRadius := v.Float("ratio"), v.Float("min")*0.5
+	circles := 2.0
+	if d := ratio * (1.0 - ratio) / (2.0 * minRadius); d >= ratio {
+		n := math.Floor(math.Sqrt((d - ratio) / ((1.0 - ratio) * (1.0 - ratio))))
+		circles += 2.0*n + 1.0
+	}
+	return circleEstimate(math.Min(circles, maxCircles))
+}
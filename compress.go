@@ -0,0 +1,164 @@
+package main
+
+import (
+	"compress/gzip"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Whether a response of the given type is worth compressing, pictures such as png
+// already being compressed
+func compressible(contentType string) bool {
+	return strings.HasPrefix(contentType, "text/") || strings.Contains(contentType, "svg+xml") ||
+		strings.Contains(contentType, "json") || strings.Contains(contentType, "javascript")
+}
+
+// Whether a request's Accept-Encoding header takes gzip, either by name or as any
+// coding not named
+func acceptsGzip(req *http.Request) bool {
+	named, other := -1.0, -1.0 // the quality given gzip and *, or -1 if it isn't listed
+	for _, coding := range strings.Split(req.Header.Get("Accept-Encoding"), ",") {
+		parts := strings.Split(coding, ";")
+		q := 1.0
+		for _, param := range parts[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				var err error
+				if q, err = strconv.ParseFloat(param[2:], 64); err != nil {
+					q = 0.0
+				}
+			}
+		}
+		switch strings.ToLower(strings.TrimSpace(parts[0])) {
+		case "gzip", "x-gzip":
+			named = math.Max(named, q)
+		case "*":
+			other = math.Max(other, q)
+		}
+	}
+	if named >= 0.0 {
+		return named > 0.0
+	}
+	return other > 0.0
+}
+
+// Gzips a response as it is written, once its header shows it is worth it
+type gzipResponse struct {
+	http.ResponseWriter
+	gz          *gzip.Writer
+	wroteHeader bool
+}
+
+func (g *gzipResponse) WriteHeader(status int) {
+	if g.wroteHeader {
+		return
+	}
+	g.wroteHeader = true
+	h := g.Header()
+	if status == http.StatusOK && h.Get("Content-Encoding") == "" && compressible(h.Get("Content-Type")) {
+		h.Set("Content-Encoding", "gzip")
+		h.Del("Content-Length")
+		// the gzipped bytes differ from the cached ones the etag names
+		if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			h.Set("ETag", "W/"+etag)
+		}
+		g.gz = gzip.NewWriter(g.ResponseWriter)
+	}
+	g.ResponseWriter.WriteHeader(status)
+}
+
+func (g *gzipResponse) Write(b []byte) (int, error) {
+	if !g.wroteHeader {
+		if g.Header().Get("Content-Type") == "" {
+			g.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		g.WriteHeader(http.StatusOK)
+	}
+	if g.gz != nil {
+		return g.gz.Write(b)
+	}
+	return g.ResponseWriter.Write(b)
+}
+
+func (g *gzipResponse) Flush() {
+	if g.gz != nil {
+		g.gz.Flush()
+	}
+	if f, ok := g.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Gzip the responses of h for the clients that accept it.  A handler that panics,
+// such as one whose render was stopped, is left without the gzip trailer, so the
+// client can't mistake what it got for the whole picture.
+func gzipHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if !acceptsGzip(req) {
+			h.ServeHTTP(w, req)
+			return
+		}
+		g := &gzipResponse{ResponseWriter: w}
+		h.ServeHTTP(g, req)
+		if g.gz != nil {
+			g.gz.Close()
+		}
+	})
+}
+
+// Writes a picture as an svgz download, whatever compression the client asked for
+type svgzResponse struct {
+	http.ResponseWriter
+	gz       *gzip.Writer
+	filename string
+	status   int
+}
+
+func newSVGZResponse(w http.ResponseWriter, name string) *svgzResponse {
+	return &svgzResponse{ResponseWriter: w, filename: name + ".svgz"}
+}
+
+func (z *svgzResponse) WriteHeader(status int) {
+	if z.status != 0 {
+		return
+	}
+	z.status = status
+	if status == http.StatusOK {
+		h := z.Header()
+		h.Set("Content-Type", "image/svg+xml")
+		h.Set("Content-Encoding", "gzip")
+		h.Set("Content-Disposition", `attachment; filename="`+z.filename+`"`)
+		z.gz = gzip.NewWriter(z.ResponseWriter)
+	}
+	z.ResponseWriter.WriteHeader(status)
+}
+
+func (z *svgzResponse) Write(b []byte) (int, error) {
+	if z.status == 0 {
+		z.WriteHeader(http.StatusOK)
+	}
+	if z.gz != nil {
+		return z.gz.Write(b)
+	}
+	return z.ResponseWriter.Write(b)
+}
+
+func (z *svgzResponse) Flush() {
+	if z.gz != nil {
+		z.gz.Flush()
+	}
+	if f, ok := z.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Finish the gzip stream of a picture that was drawn to the end
+func (z *svgzResponse) Close() error {
+	if z.gz == nil {
+		return nil
+	}
+	return z.gz.Close()
+}
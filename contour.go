@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"github.com/ajstarks/svgo"
+	"strings"
+)
+
+// Find the iso-contours of a scalar field at the given level using marching squares.
+//
+// field is indexed as field[y][x], with the sample (x, y) lying at the point (x, y).
+// The field is treated as if it were surrounded by values below level, so every
+// contour returned is a closed loop, and the loops together bound the region where
+// the field is at or above level.
+func Contours(field [][]float64, level float64) [][]Point {
+	height := len(field)
+	if height == 0 {
+		return nil
+	}
+	width := len(field[0])
+
+	// sample the field with a one sample border below the level
+	nx, ny := width+2, height+2
+	value := func(x, y int) float64 {
+		if x <= 0 || y <= 0 || x >= nx-1 || y >= ny-1 {
+			return level - 1.0
+		}
+		return field[y-1][x-1]
+	}
+	inside := func(x, y int) bool {
+		return value(x, y) >= level
+	}
+
+	// each crossing is identified by the grid edge it lies on, horizontal edges
+	// have even ids and vertical edges odd ids
+	points := make(map[int]Point)
+	links := make(map[int][]int)
+	crossing := func(x1, y1, x2, y2 int) int {
+		var id int
+		if y1 == y2 {
+			id = (y1*nx + x1) * 2
+		} else {
+			id = (y1*nx+x1)*2 + 1
+		}
+		if _, ok := points[id]; !ok {
+			v1, v2 := value(x1, y1), value(x2, y2)
+			t := 0.5
+			if v1 != v2 {
+				t = (level - v1) / (v2 - v1)
+			}
+			points[id] = Point{X: float64(x1) + t*float64(x2-x1) - 1.0, Y: float64(y1) + t*float64(y2-y1) - 1.0}
+		}
+		return id
+	}
+	link := func(a, b int) {
+		links[a] = append(links[a], b)
+		links[b] = append(links[b], a)
+	}
+
+	for y := 0; y < ny-1; y++ {
+		for x := 0; x < nx-1; x++ {
+			c := 0
+			if inside(x, y) {
+				c |= 1
+			}
+			if inside(x+1, y) {
+				c |= 2
+			}
+			if inside(x+1, y+1) {
+				c |= 4
+			}
+			if inside(x, y+1) {
+				c |= 8
+			}
+			if c == 0 || c == 15 {
+				continue
+			}
+
+			top := func() int { return crossing(x, y, x+1, y) }
+			right := func() int { return crossing(x+1, y, x+1, y+1) }
+			bottom := func() int { return crossing(x, y+1, x+1, y+1) }
+			left := func() int { return crossing(x, y, x, y+1) }
+
+			switch c {
+			case 1, 14:
+				link(left(), top())
+			case 2, 13:
+				link(top(), right())
+			case 3, 12:
+				link(left(), right())
+			case 4, 11:
+				link(right(), bottom())
+			case 6, 9:
+				link(top(), bottom())
+			case 7, 8:
+				link(left(), bottom())
+			case 5, 10:
+				// saddle, resolve it using the value at the centre of the cell
+				centre := (value(x, y) + value(x+1, y) + value(x+1, y+1) + value(x, y+1)) / 4.0
+				if (centre >= level) == (c == 5) {
+					link(left(), bottom())
+					link(top(), right())
+				} else {
+					link(left(), top())
+					link(right(), bottom())
+				}
+			}
+		}
+	}
+
+	// walk the links to join the segments into loops
+	var loops [][]Point
+	visited := make(map[int]bool)
+	for start := range links {
+		if visited[start] {
+			continue
+		}
+		var loop []Point
+		prev, cur := -1, start
+		for !visited[cur] {
+			visited[cur] = true
+			loop = append(loop, points[cur])
+			next := -1
+			for _, n := range links[cur] {
+				if n != prev && !visited[n] {
+					next = n
+					break
+				}
+			}
+			if next < 0 {
+				break
+			}
+			prev, cur = cur, next
+		}
+		if len(loop) > 2 {
+			loops = append(loops, loop)
+		}
+	}
+	return loops
+}
+
+// Build svg path data for a set of closed loops, placed on the canvas by view
+func loopsPath(loops [][]Point, view *Matrix) string {
+	var d strings.Builder
+	for _, loop := range loops {
+		for i, p := range loop {
+			p = view.Apply(p)
+			if i == 0 {
+				fmt.Fprintf(&d, "M%.1f %.1f", p.X, p.Y)
+			} else {
+				fmt.Fprintf(&d, "L%.1f %.1f", p.X, p.Y)
+			}
+		}
+		d.WriteString("Z")
+	}
+	return d.String()
+}
+
+// Draw the region where the field is at or above level as a filled path
+func renderContourRegion(s *svg.SVG, field [][]float64, level float64, view *Matrix, style string) {
+	loops := Contours(field, level)
+	if len(loops) > 0 {
+		s.Path(loopsPath(loops, view), "fill-rule:evenodd;"+style)
+	}
+}
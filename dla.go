@@ -0,0 +1,243 @@
+package main
+
+import (
+	"fmt"
+	"github.com/ajstarks/svgo"
+	"math"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// A cluster grown by diffusion limited aggregation.  Each particle after the first
+// records the particle it stuck to.
+type DLACluster struct {
+	Points []Point
+	Parent []int
+	radius float64 // the furthest any particle lies from the seed
+}
+
+// Create a cluster holding just the seed particle at the origin
+func NewDLACluster() *DLACluster {
+	return &DLACluster{Points: []Point{{}}, Parent: []int{-1}}
+}
+
+// Add a particle stuck to parent
+func (c *DLACluster) add(p Point, parent int) {
+	c.Points = append(c.Points, p)
+	c.Parent = append(c.Parent, parent)
+	c.radius = math.Max(c.radius, math.Hypot(p.X, p.Y))
+}
+
+// The size of the cells particles are bucketed in, walkers with no particles in
+// the neighbouring cells can take steps almost this long
+const dlaCell = 8.0
+
+// The particles of a cluster bucketed by cell, for finding the nearest quickly
+type dlaGrid map[[2]int][]int
+
+func (g dlaGrid) cell(p Point) [2]int {
+	return [2]int{int(math.Floor(p.X / dlaCell)), int(math.Floor(p.Y / dlaCell))}
+}
+
+func (g dlaGrid) add(p Point, i int) {
+	k := g.cell(p)
+	g[k] = append(g[k], i)
+}
+
+// Return the nearest particle to p and its distance, or -1 if there are none
+// within dlaCell of p
+func (g dlaGrid) nearest(p Point, points []Point) (int, float64) {
+	best, distance := -1, math.Inf(1)
+	k := g.cell(p)
+	for dx := -1; dx <= 1; dx++ {
+		for dy := -1; dy <= 1; dy++ {
+			for _, i := range g[[2]int{k[0] + dx, k[1] + dy}] {
+				if d := math.Hypot(p.X-points[i].X, p.Y-points[i].Y); d < distance {
+					best, distance = i, d
+				}
+			}
+		}
+	}
+	return best, distance
+}
+
+// Return a point at random on the circle of radius r around p
+func randomStep(p Point, r float64, rnd *rand.Rand) Point {
+	sin, cos := math.Sincos(rnd.Float64() * 2.0 * math.Pi)
+	return Point{X: p.X + r*cos, Y: p.Y + r*sin}
+}
+
+// Grow the cluster with particles of diameter 1 walking in continuous space, until
+// it holds the given number of particles or the deadline passes.  Returns false if
+// it ran out of time.
+func (c *DLACluster) growOffLattice(particles int, stickiness float64, deadline time.Time, rnd *rand.Rand) bool {
+	grid := make(dlaGrid)
+	for i, p := range c.Points {
+		grid.add(p, i)
+	}
+
+	for len(c.Points) < particles {
+		launch := c.radius + 5.0
+		p := randomStep(Point{}, launch, rnd)
+		for steps := 0; ; steps++ {
+			if steps%1024 == 0 && time.Now().After(deadline) {
+				return false
+			}
+			d := math.Hypot(p.X, p.Y)
+			if d > 2.0*launch+10.0 {
+				p = randomStep(Point{}, launch, rnd)
+				continue
+			}
+			// far from the cluster the walker can jump straight to its edge
+			if d > c.radius+3.0 {
+				p = randomStep(p, d-c.radius-2.0, rnd)
+				continue
+			}
+			parent, distance := grid.nearest(p, c.Points)
+			if parent < 0 {
+				p = randomStep(p, dlaCell-1.0, rnd)
+				continue
+			}
+			if distance <= 1.0 && rnd.Float64() < stickiness {
+				// move the particle back along the line to its parent until they touch
+				q := c.Points[parent]
+				if distance > 0.0 {
+					p = Point{X: q.X + (p.X-q.X)/distance, Y: q.Y + (p.Y-q.Y)/distance}
+				} else {
+					p = randomStep(q, 1.0, rnd)
+				}
+				c.add(p, parent)
+				grid.add(p, len(c.Points)-1)
+				break
+			}
+			// every particle is at least distance away, so step as far as possible
+			// without overlapping one
+			p = randomStep(p, math.Max(0.5, distance-1.0), rnd)
+		}
+	}
+	return true
+}
+
+// Grow the cluster with walkers stepping between the points of a square lattice,
+// sticking when they land next to an occupied point.  Returns false if it ran out
+// of time.
+func (c *DLACluster) growLattice(particles int, stickiness float64, deadline time.Time, rnd *rand.Rand) bool {
+	directions := [][2]int{{1, 0}, {-1, 0}, {0, 1}, {0, -1}}
+	occupied := make(map[[2]int]int)
+	grid := make(dlaGrid)
+	for i, p := range c.Points {
+		occupied[[2]int{int(p.X), int(p.Y)}] = i
+		grid.add(p, i)
+	}
+	launchAt := func(r float64) [2]int {
+		p := randomStep(Point{}, r, rnd)
+		return [2]int{int(math.Round(p.X)), int(math.Round(p.Y))}
+	}
+
+	for len(c.Points) < particles {
+		launch := c.radius + 5.0
+		p := launchAt(launch)
+		for steps := 0; ; steps++ {
+			if steps%1024 == 0 && time.Now().After(deadline) {
+				return false
+			}
+			d := math.Hypot(float64(p[0]), float64(p[1]))
+			if d > 2.0*launch+10.0 {
+				p = launchAt(launch)
+				continue
+			}
+			if d > c.radius+4.0 {
+				q := randomStep(Point{X: float64(p[0]), Y: float64(p[1])}, d-c.radius-3.0, rnd)
+				p = [2]int{int(math.Round(q.X)), int(math.Round(q.Y))}
+				continue
+			}
+			// away from the cluster jump as far as possible, rounding to the lattice
+			here := Point{X: float64(p[0]), Y: float64(p[1])}
+			if nearest, distance := grid.nearest(here, c.Points); nearest < 0 || distance > 3.0 {
+				q := randomStep(here, math.Min(dlaCell, distance)-2.0, rnd)
+				p = [2]int{int(math.Round(q.X)), int(math.Round(q.Y))}
+				continue
+			}
+			parent := -1
+			if _, ok := occupied[p]; !ok {
+				for _, dir := range directions {
+					if i, ok := occupied[[2]int{p[0] + dir[0], p[1] + dir[1]}]; ok {
+						parent = i
+						break
+					}
+				}
+			}
+			if parent >= 0 && rnd.Float64() < stickiness {
+				c.add(Point{X: float64(p[0]), Y: float64(p[1])}, parent)
+				occupied[p] = len(c.Points) - 1
+				grid.add(c.Points[len(c.Points)-1], len(c.Points)-1)
+				break
+			}
+			dir := directions[rnd.Intn(len(directions))]
+			p = [2]int{p[0] + dir[0], p[1] + dir[1]}
+		}
+	}
+	return true
+}
+
+// Draw a segment from each particle to the one it stuck to, coloured by the order
+// they arrived in
+func renderDLA(s *svg.SVG, c *DLACluster, colors []string, size, margin int) {
+	low, high := treeBounds([]treePart{{Points: c.Points}})
+	view := NewFitMatrix(low, high, float64(size), float64(margin))
+	width := math.Max(1.0, 0.5*math.Sqrt(math.Abs(view.Determinant())))
+
+	for i, parent := range c.Parent {
+		if parent < 0 {
+			continue
+		}
+		color := colors[i*len(colors)/len(c.Points)]
+		l := NewLine3(c.Points[parent], c.Points[i]).Transform(view)
+		l.RenderStyle(s, fmt.Sprintf("fill:none;stroke-linecap:round;stroke:%s;stroke-width:%.1f", color, width))
+	}
+}
+
+func dlaHandler(w http.ResponseWriter, req *http.Request, v Values) {
+	const (
+		colorBands = 64
+
+		size   = 1000
+		margin = 20
+	)
+
+	particles := v.Int("particles")
+	stickiness := v.Float("stickiness")
+	colors, err := bandColors(v.String("palette"), colorBands)
+	if err != nil {
+		paramError(w, "palette", err)
+		return
+	}
+
+	rnd := seededRand(v)
+	deadline := time.Now().Add(time.Duration(v.Float("budget") * float64(time.Second)))
+	cluster := NewDLACluster()
+	var finished bool
+	if v.Bool("lattice") {
+		finished = cluster.growLattice(particles, stickiness, deadline, rnd)
+	} else {
+		finished = cluster.growOffLattice(particles, stickiness, deadline, rnd)
+	}
+	if !finished {
+		fmt.Println("DLA ran out of time after", len(cluster.Points), "of", particles, "particles")
+		// how far it got depends on how busy the server was
+		w.Header().Set("Cache-Control", "no-store")
+	}
+
+	w.Header().Set("Content-Type", "image/svg+xml")
+	s := svg.New(w)
+	s.Start(size, size)
+	defer s.End()
+
+	renderDLA(s, cluster, colors, size, margin)
+}
+
+// Each particle is joined to the one it stuck to by a line
+func dlaEstimate(v Values) Estimate {
+	return lineEstimate(float64(v.Int("particles")))
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/ajstarks/svgo"
+	"math"
+	"math/cmplx"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// The view and iteration settings of an escape time fractal
+type EscapeOptions struct {
+	Center     complex128
+	Zoom       float64
+	Iterations int
+	Julia      bool
+	C          complex128 // the julia set constant
+}
+
+// Named palettes, each a list of colour stops
+var (
+	palettes = map[string][]string{
+		"gray":    {"#000000", "#ffffff"},
+		"fire":    {"#000000", "#800000", "#ff4000", "#ffff00", "#ffffff"},
+		"ocean":   {"#000020", "#0040a0", "#00c0ff", "#ffffff"},
+		"forest":  {"#001000", "#206020", "#a0d060", "#ffffe0"},
+		"basins":  {"#e41a1c", "#ff7f00", "#ffff33", "#4daf4a", "#377eb8", "#984ea3"},
+		"terrain": {"#1a3c6e", "#3e7cb1", "#e8d8a0", "#5a9a3c", "#2e5e2a", "#8a7a6a", "#ffffff"},
+	}
+)
+
+// Return the smoothed escape time of z under z = z^2 + c, or the iteration
+// limit if it does not escape
+func escapeTime(z, c complex128, iterations int) float64 {
+	const bailout = 256.0
+
+	for i := 0; i < iterations; i++ {
+		z = z*z + c
+		if r := cmplx.Abs(z); r > bailout {
+			return math.Max(0.0, float64(i)+1.0-math.Log2(math.Log(r)))
+		}
+	}
+	return float64(iterations)
+}
+
+// Return a function giving the point of the complex plane at sample (x, y) of a
+// width x height grid centred on center.  A zoom of 1 shows a region 4 units across.
+func complexGrid(center complex128, zoom float64, width, height int) func(x, y int) complex128 {
+	span := 4.0 / zoom
+	step := span / float64(width-1)
+	top := imag(center) + step*float64(height-1)/2.0
+	left := real(center) - span/2.0
+
+	return func(x, y int) complex128 {
+		return complex(left+float64(x)*step, top-float64(y)*step)
+	}
+}
+
+// Compute the escape time at each point of a width x height grid covering the view
+func escapeField(options *EscapeOptions, width, height int) [][]float64 {
+	at := complexGrid(options.Center, options.Zoom, width, height)
+
+	field := make([][]float64, height)
+	for y := range field {
+		field[y] = make([]float64, width)
+		for x := range field[y] {
+			p := at(x, y)
+			if options.Julia {
+				field[y][x] = escapeTime(p, options.C, options.Iterations)
+			} else {
+				field[y][x] = escapeTime(0, p, options.Iterations)
+			}
+		}
+	}
+	return field
+}
+
+// Parse a colour in the form rrggbb or #rrggbb
+func parseColor(value string) ([3]float64, error) {
+	var rgb [3]float64
+	value = strings.TrimPrefix(strings.TrimSpace(value), "#")
+	if len(value) != 6 {
+		return rgb, errors.New("invalid colour " + value)
+	}
+	for i := range rgb {
+		c, err := strconv.ParseUint(value[i*2:i*2+2], 16, 8)
+		if err != nil {
+			return rgb, err
+		}
+		rgb[i] = float64(c)
+	}
+	return rgb, nil
+}
+
+// Spread a number of colours evenly along a palette, given either as the name of
+// one of the built in palettes or a comma separated list of colour stops
+func bandColors(palette string, bands int) ([]string, error) {
+	stops, ok := palettes[palette]
+	if !ok {
+		stops = strings.Split(palette, ",")
+	}
+	rgb := make([][3]float64, len(stops))
+	for i, stop := range stops {
+		var err error
+		if rgb[i], err = parseColor(stop); err != nil {
+			return nil, err
+		}
+	}
+
+	colors := make([]string, bands)
+	for i := range colors {
+		c := rgb[0]
+		if len(rgb) > 1 && bands > 1 {
+			t := float64(i) / float64(bands-1) * float64(len(rgb)-1)
+			j := int(t)
+			if j >= len(rgb)-1 {
+				j = len(rgb) - 2
+			}
+			f := t - float64(j)
+			for k := range c {
+				c[k] = rgb[j][k] + f*(rgb[j+1][k]-rgb[j][k])
+			}
+		}
+		colors[i] = fmt.Sprintf("#%02x%02x%02x", int(c[0]), int(c[1]), int(c[2]))
+	}
+	return colors, nil
+}
+
+// Draw the fractal as a stack of filled regions, one per band of escape time,
+// with the points that never escape drawn in black on top
+func escapeFractal(s *svg.SVG, options *EscapeOptions, colors []string, grid, size int) {
+	field := escapeField(options, grid, grid)
+
+	view := NewMatrix()
+	view.Scale(float64(size)/float64(grid-1), float64(size)/float64(grid-1))
+
+	// band edges are spaced geometrically, most points escape quickly
+	bands := len(colors)
+	s.Rect(0, 0, size, size, "fill:"+colors[0])
+	for i := 1; i < bands; i++ {
+		level := math.Pow(float64(options.Iterations), float64(i)/float64(bands))
+		renderContourRegion(s, field, level, view, "stroke:none;fill:"+colors[i])
+	}
+	renderContourRegion(s, field, float64(options.Iterations)-0.5, view, "stroke:none;fill:black")
+}
+
+// Create a handler drawing the mandelbrot set, or julia sets if julia is set
+func escapeHandler(julia bool) RenderFunc {
+	return func(w http.ResponseWriter, req *http.Request, v Values) {
+		const size = 1000
+
+		options := &EscapeOptions{
+			Julia:      julia,
+			Center:     complex(v.Float("cx"), v.Float("cy")),
+			Zoom:       v.Float("zoom"),
+			Iterations: v.Int("iterations"),
+		}
+		if julia {
+			options.C = complex(v.Float("cr"), v.Float("ci"))
+		}
+
+		colors, err := bandColors(v.String("palette"), v.Int("bands"))
+		if err != nil {
+			paramError(w, "palette", err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "image/svg+xml")
+		s := svg.New(w)
+		s.Start(size, size)
+		defer s.End()
+
+		escapeFractal(s, options, colors, v.Int("grid"), size)
+	}
+}
+
+// The points typically on the contours of a region of an escape time or newton
+// fractal, per sample across the grid
+const fieldContourPoints = 6.0
+
+// A region is drawn for each band but the first, and for the points that never escape
+func escapeEstimate(v Values) Estimate {
+	return contourEstimate(float64(v.Int("bands")), fieldContourPoints*float64(v.Int("grid")))
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+)
+
+// The rough size in bytes of each thing drawn, including its style
+const (
+	svgHeaderBytes = 150
+	lineBytes      = 75 // a line, or a path's move to and line to
+	polygonBytes   = 50 // a polygon, plus vertexBytes for each vertex
+	vertexBytes    = 9
+	pathPointBytes = 12
+	circleBytes    = 65
+	rectBytes      = 75
+	pixelBytes     = 4 // an image is held as rgba pixels before it is encoded
+)
+
+// A prediction of how much drawing a fractal takes, made from its parameters alone
+type Estimate struct {
+	Segments float64 `json:"segments"` // lines, polygon edges, circles and dots drawn
+	Bytes    float64 `json:"bytes"`    // of the response
+}
+
+// Predict how much drawing a fractal takes.  Parameters the handler goes on to reject
+// may be estimated as drawing nothing.
+type EstimateFunc func(v Values) Estimate
+
+// Estimate an svg of lines
+func lineEstimate(lines float64) Estimate {
+	return Estimate{Segments: lines, Bytes: svgHeaderBytes + lines*lineBytes}
+}
+
+// Estimate an svg of polygons, each with the given number of vertices
+func polygonEstimate(polygons float64, vertices int) Estimate {
+	return Estimate{Segments: polygons * float64(vertices), Bytes: svgHeaderBytes + polygons*(polygonBytes+float64(vertices)*vertexBytes)}
+}
+
+// Estimate an svg of circles
+func circleEstimate(circles float64) Estimate {
+	return Estimate{Segments: circles, Bytes: svgHeaderBytes + circles*circleBytes}
+}
+
+// Estimate an svg of single pixel rectangles
+func dotEstimate(dots float64) Estimate {
+	return Estimate{Segments: dots, Bytes: svgHeaderBytes + dots*rectBytes}
+}
+
+// Estimate an svg of filled contour regions drawn over a rectangle, each a path through
+// the given number of points
+func contourEstimate(regions, points float64) Estimate {
+	return Estimate{Segments: regions * points, Bytes: svgHeaderBytes + rectBytes + regions*(polygonBytes+points*pathPointBytes)}
+}
+
+// Estimate a width x height image
+func imageEstimate(width, height int) Estimate {
+	return Estimate{Bytes: float64(width) * float64(height) * pixelBytes}
+}
+
+// Return the number of things drawn when each is replaced by pieces more, depth times
+func powerOf(pieces, depth int) float64 {
+	return math.Pow(float64(pieces), float64(depth))
+}
+
+// Whether the estimate fits the budget set by the -segments and -bytes flags
+func (e Estimate) WithinBudget() bool {
+	return e.Segments <= *maxSegments && e.Bytes <= *maxBytes
+}
+
+// Return the problem with a drawing of the given estimate if it would go over the
+// budget, or nil
+func checkBudget(e Estimate) []FieldError {
+	if e.WithinBudget() {
+		return nil
+	}
+	return []FieldError{{Message: fmt.Sprintf("drawing this would take about %.3g segments and %.3g bytes, over the budget of %.3g segments and %.3g bytes",
+		e.Segments, e.Bytes, *maxSegments, *maxBytes)}}
+}
+
+// Report how much drawing the fractal named by the fractal parameter would take, given
+// the rest of the url parameters
+func estimateHandler(w http.ResponseWriter, req *http.Request) {
+	name := req.URL.Query().Get("fractal")
+	f := findFractal(name)
+	if f == nil {
+		writeJSONErrors(w, http.StatusBadRequest, []FieldError{{Field: "fractal", Message: "unknown fractal " + strconv.Quote(name)}})
+		return
+	}
+	v, problems := f.Parse(req)
+	if len(problems) > 0 {
+		writeJSONErrors(w, http.StatusBadRequest, problems)
+		return
+	}
+
+	e := f.estimate(v)
+	writeJSON(w, http.StatusOK, struct {
+		Fractal string `json:"fractal"`
+		Estimate
+		MaxSegments  float64 `json:"max_segments"`
+		MaxBytes     float64 `json:"max_bytes"`
+		WithinBudget bool    `json:"within_budget"`
+	}{Fractal: f.Name, Estimate: e, MaxSegments: *maxSegments, MaxBytes: *maxBytes, WithinBudget: e.WithinBudget()})
+}
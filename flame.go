@@ -0,0 +1,370 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"math/rand"
+	"net/http"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// Upper bound on the number of points a flame may plot
+const maxFlameSamples = 1 << 28
+
+// The number of independently seeded jobs a flame's samples are split into, fixed so
+// the image does not depend on how many workers render it
+const flameJobs = 64
+
+// The bytes held for each pixel of a flame while it is rendered, a histogram of four
+// counts and then the rgba image it is tone mapped to
+const flamePixelBytes = 4*8 + pixelBytes
+
+// A variation, a non-linear function applied to each point after the affine map
+type Variation func(p Point) Point
+
+// The variations a flame transform may blend
+var (
+	flameVariations = map[string]Variation{
+		"linear": func(p Point) Point {
+			return p
+		},
+		"sinusoidal": func(p Point) Point {
+			return Point{X: math.Sin(p.X), Y: math.Sin(p.Y)}
+		},
+		"spherical": func(p Point) Point {
+			r2 := p.X*p.X + p.Y*p.Y + 1e-12
+			return Point{X: p.X / r2, Y: p.Y / r2}
+		},
+		"swirl": func(p Point) Point {
+			r2 := p.X*p.X + p.Y*p.Y
+			sin, cos := math.Sincos(r2)
+			return Point{X: p.X*sin - p.Y*cos, Y: p.X*cos + p.Y*sin}
+		},
+		"horseshoe": func(p Point) Point {
+			r := math.Hypot(p.X, p.Y) + 1e-12
+			return Point{X: (p.X - p.Y) * (p.X + p.Y) / r, Y: 2.0 * p.X * p.Y / r}
+		},
+		"polar": func(p Point) Point {
+			return Point{X: math.Atan2(p.X, p.Y) / math.Pi, Y: math.Hypot(p.X, p.Y) - 1.0}
+		},
+		"heart": func(p Point) Point {
+			r := math.Hypot(p.X, p.Y)
+			sin, cos := math.Sincos(math.Atan2(p.X, p.Y) * r)
+			return Point{X: r * sin, Y: -r * cos}
+		},
+		"disc": func(p Point) Point {
+			theta := math.Atan2(p.X, p.Y) / math.Pi
+			sin, cos := math.Sincos(math.Pi * math.Hypot(p.X, p.Y))
+			return Point{X: theta * sin, Y: theta * cos}
+		},
+	}
+)
+
+// One transform of a fractal flame, an affine map followed by a weighted blend of
+// variations.  Each time it is chosen the point's colour moves halfway to Color.
+type FlameTransform struct {
+	Coefs      []float64          `json:"coefs"` // a, b, c, d, e, f as for an IFS map
+	Weight     float64            `json:"weight"`
+	Color      float64            `json:"color"` // a position along the palette, in [0, 1]
+	Variations map[string]float64 `json:"variations"`
+
+	affine     *Matrix
+	variations []Variation
+	blend      []float64
+}
+
+// A fractal flame and the view it is rendered with
+type Flame struct {
+	Transforms []*FlameTransform `json:"transforms"`
+	Palette    string            `json:"palette"`
+	Width      int               `json:"width"`
+	Height     int               `json:"height"`
+	Center     [2]float64        `json:"center"`
+	Scale      float64           `json:"scale"`   // pixels per unit
+	Quality    int               `json:"quality"` // samples per pixel
+	Gamma      float64           `json:"gamma"`
+	Brightness float64           `json:"brightness"`
+	Seed       int64             `json:"seed"`
+
+	colors [][3]float64
+}
+
+// Read a flame from its JSON definition, filling in defaults and checking each field
+func ParseFlame(definition []byte) (*Flame, error) {
+	const (
+		defaultSize    = 800
+		maxSize        = 4000
+		defaultQuality = 50
+		defaultPalette = "fire"
+	)
+
+	flame := &Flame{}
+	if err := json.Unmarshal(definition, flame); err != nil {
+		return nil, err
+	}
+
+	if flame.Width == 0 {
+		flame.Width = defaultSize
+	}
+	if flame.Height == 0 {
+		flame.Height = defaultSize
+	}
+	if flame.Width < 1 || flame.Height < 1 || flame.Width > maxSize || flame.Height > maxSize {
+		return nil, fmt.Errorf("width and height must be in [1, %d]", maxSize)
+	}
+	if flame.Scale == 0.0 {
+		flame.Scale = float64(flame.Width) / 4.0
+	}
+	if flame.Quality == 0 {
+		flame.Quality = defaultQuality
+	}
+	if flame.Quality < 1 || int64(flame.Quality)*int64(flame.Width)*int64(flame.Height) > maxFlameSamples {
+		return nil, fmt.Errorf("quality must be positive and at most %d samples in total", maxFlameSamples)
+	}
+	if flame.Gamma == 0.0 {
+		flame.Gamma = 2.2
+	}
+	if flame.Brightness == 0.0 {
+		flame.Brightness = 1.0
+	}
+	if flame.Gamma < 0.0 || flame.Brightness < 0.0 {
+		return nil, errors.New("gamma and brightness must be positive")
+	}
+	if flame.Palette == "" {
+		flame.Palette = defaultPalette
+	}
+	colors, err := bandColors(flame.Palette, 256)
+	if err != nil {
+		return nil, err
+	}
+	flame.colors = make([][3]float64, len(colors))
+	for i, c := range colors {
+		if flame.colors[i], err = parseColor(c); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(flame.Transforms) == 0 {
+		return nil, errors.New("a flame needs at least one transform")
+	}
+	total := 0.0
+	for i, t := range flame.Transforms {
+		if len(t.Coefs) != 6 {
+			return nil, fmt.Errorf("transform %d needs 6 coefficients", i)
+		}
+		if t.Weight < 0.0 || t.Color < 0.0 || t.Color > 1.0 {
+			return nil, fmt.Errorf("transform %d needs a positive weight and a colour in [0, 1]", i)
+		}
+		if t.Weight == 0.0 {
+			t.Weight = 1.0
+		}
+		total += t.Weight
+		t.affine = NewAffineMatrix(t.Coefs[0], t.Coefs[1], t.Coefs[2], t.Coefs[3], t.Coefs[4], t.Coefs[5])
+
+		if len(t.Variations) == 0 {
+			t.Variations = map[string]float64{"linear": 1.0}
+		}
+		// visit the variations in a fixed order so sums round the same way every time
+		names := make([]string, 0, len(t.Variations))
+		for name := range t.Variations {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			v, ok := flameVariations[name]
+			if !ok {
+				return nil, fmt.Errorf("transform %d has unknown variation %s", i, name)
+			}
+			t.variations = append(t.variations, v)
+			t.blend = append(t.blend, t.Variations[name])
+		}
+	}
+	for _, t := range flame.Transforms {
+		t.Weight /= total
+	}
+	return flame, nil
+}
+
+// Apply the transform to p
+func (t *FlameTransform) Apply(p Point) Point {
+	p = t.affine.Apply(p)
+	var q Point
+	for i, v := range t.variations {
+		r := v(p)
+		q.X += t.blend[i] * r.X
+		q.Y += t.blend[i] * r.Y
+	}
+	return q
+}
+
+// Pick a transform at random, weighted by the transform weights
+func (flame *Flame) choose(rnd *rand.Rand) *FlameTransform {
+	r := rnd.Float64()
+	for _, t := range flame.Transforms {
+		r -= t.Weight
+		if r <= 0.0 {
+			return t
+		}
+	}
+	return flame.Transforms[len(flame.Transforms)-1]
+}
+
+// Play the chaos game for one job, adding the count and colour of each point that
+// lands on the image to the histogram.  The histogram holds integers so the totals
+// do not depend on the order the jobs finish in.
+func (flame *Flame) sample(histogram []uint64, samples int, rnd *rand.Rand) {
+	const settle = 20
+
+	reset := func() (Point, float64) {
+		return Point{X: rnd.Float64()*2.0 - 1.0, Y: rnd.Float64()*2.0 - 1.0}, rnd.Float64()
+	}
+	p, c := reset()
+	for i := 0; i < samples+settle; i++ {
+		t := flame.choose(rnd)
+		p = t.Apply(p)
+		c = (c + t.Color) / 2.0
+		if math.IsNaN(p.X) || math.IsNaN(p.Y) || math.Abs(p.X) > 1e10 || math.Abs(p.Y) > 1e10 {
+			p, c = reset()
+			continue
+		}
+		if i < settle {
+			continue
+		}
+
+		x := int(math.Floor((p.X-flame.Center[0])*flame.Scale + float64(flame.Width)/2.0))
+		y := int(math.Floor(float64(flame.Height)/2.0 - (p.Y-flame.Center[1])*flame.Scale))
+		if x < 0 || y < 0 || x >= flame.Width || y >= flame.Height {
+			continue
+		}
+		rgb := flame.colors[int(c*float64(len(flame.colors)-1))]
+		k := (y*flame.Width + x) * 4
+		atomic.AddUint64(&histogram[k], 1)
+		atomic.AddUint64(&histogram[k+1], uint64(rgb[0]))
+		atomic.AddUint64(&histogram[k+2], uint64(rgb[1]))
+		atomic.AddUint64(&histogram[k+3], uint64(rgb[2]))
+	}
+}
+
+// Render the flame, sharing the jobs between a pool of workers, then tone map the
+// histogram with the log of each pixel's density
+func (flame *Flame) Render() image.Image {
+	histogram := make([]uint64, flame.Width*flame.Height*4)
+	total := flame.Quality * flame.Width * flame.Height
+
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < runtime.NumCPU(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				samples := total / flameJobs
+				if job == flameJobs-1 {
+					samples += total % flameJobs
+				}
+				flame.sample(histogram, samples, rand.New(rand.NewSource(flame.Seed*flameJobs+int64(job))))
+			}
+		}()
+	}
+	for job := 0; job < flameJobs; job++ {
+		jobs <- job
+	}
+	close(jobs)
+	wg.Wait()
+
+	maxCount := uint64(1)
+	for k := 0; k < len(histogram); k += 4 {
+		if histogram[k] > maxCount {
+			maxCount = histogram[k]
+		}
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, flame.Width, flame.Height))
+	scale := math.Log1p(float64(maxCount))
+	for y := 0; y < flame.Height; y++ {
+		for x := 0; x < flame.Width; x++ {
+			k := (y*flame.Width + x) * 4
+			n := histogram[k]
+			if n == 0 {
+				img.Set(x, y, color.Black)
+				continue
+			}
+			alpha := math.Min(1.0, flame.Brightness*math.Log1p(float64(n))/scale)
+			alpha = math.Pow(alpha, 1.0/flame.Gamma)
+			f := alpha / float64(n)
+			img.Set(x, y, color.RGBA{
+				R: uint8(math.Min(255.0, float64(histogram[k+1])*f)),
+				G: uint8(math.Min(255.0, float64(histogram[k+2])*f)),
+				B: uint8(math.Min(255.0, float64(histogram[k+3])*f)),
+				A: 255,
+			})
+		}
+	}
+	return img
+}
+
+// Some flames to start from, as JSON definitions
+var (
+	flamePresets = map[string]string{
+		"sierpinski": `{"transforms": [
+			{"coefs": [0.5, 0, 0, 0.5, -0.5, -0.5], "color": 0.0, "variations": {"linear": 0.7, "spherical": 0.3}},
+			{"coefs": [0.5, 0, 0, 0.5, 0.5, -0.5], "color": 0.5, "variations": {"linear": 0.7, "swirl": 0.3}},
+			{"coefs": [0.5, 0, 0, 0.5, 0, 0.5], "color": 1.0, "variations": {"linear": 0.7, "horseshoe": 0.3}}]}`,
+		"swirl": `{"palette": "ocean", "scale": 160, "transforms": [
+			{"coefs": [0.8, -0.3, 0.3, 0.8, 0.1, 0], "weight": 3, "color": 0.1, "variations": {"swirl": 1}},
+			{"coefs": [0.4, 0, 0, 0.4, 0.6, 0.2], "color": 0.9, "variations": {"sinusoidal": 0.5, "spherical": 0.5}}]}`,
+		"heart": `{"palette": "basins", "scale": 120, "transforms": [
+			{"coefs": [0.6, 0.2, -0.2, 0.6, 0, 0.3], "weight": 2, "color": 0.2, "variations": {"heart": 0.6, "linear": 0.4}},
+			{"coefs": [-0.5, 0, 0, 0.5, 0.4, -0.2], "color": 0.8, "variations": {"disc": 0.5, "polar": 0.5}}]}`,
+	}
+)
+
+// Return the flame given as a JSON body, a flame parameter or the name of a preset
+func flameOf(v Values) (*Flame, error) {
+	definition := v.body
+	if definition == nil {
+		if value := v.String("flame"); value != "" {
+			definition = []byte(value)
+		} else {
+			definition = []byte(flamePresets[v.String("preset")])
+		}
+	}
+
+	flame, err := ParseFlame(definition)
+	if err != nil {
+		return nil, err
+	}
+	if flame.Seed == 0 {
+		flame.Seed = int64(v.Int("seed"))
+	}
+	return flame, nil
+}
+
+func flameHandler(w http.ResponseWriter, req *http.Request, v Values) {
+	flame, err := flameOf(v)
+	if err != nil {
+		paramError(w, "flame", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	_ = png.Encode(w, flame.Render())
+}
+
+// A flame's size comes from its definition, which is held as a histogram and then an
+// image
+func flameEstimate(v Values) Estimate {
+	flame, err := flameOf(v)
+	if err != nil {
+		return Estimate{}
+	}
+	return Estimate{Bytes: float64(flame.Width) * float64(flame.Height) * flamePixelBytes}
+}
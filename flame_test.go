@@ -0,0 +1,31 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestFlameEstimateSeesPostedDefinition(t *testing.T) {
+	f := findFractal("flame")
+	preset, problems := f.Parse(httptest.NewRequest("GET", "/flame/", nil))
+	if len(problems) > 0 {
+		t.Fatalf("the preset was rejected: %v", problems)
+	}
+	if e := f.estimate(preset); e.Bytes != 800*800*flamePixelBytes {
+		t.Errorf("the preset was estimated at %g bytes", e.Bytes)
+	}
+
+	body := `{"width": 4000, "height": 4000, "quality": 1, "transforms": [{"coefs": [0.5, 0, 0, 0.5, 0, 0]}]}`
+	posted, problems := f.Parse(httptest.NewRequest("POST", "/flame/", strings.NewReader(body)))
+	if len(problems) > 0 {
+		t.Fatalf("the posted flame was rejected: %v", problems)
+	}
+	e := f.estimate(posted)
+	if e.Bytes != 4000*4000*flamePixelBytes {
+		t.Errorf("the posted flame was estimated at %g bytes", e.Bytes)
+	}
+	if e.WithinBudget() {
+		t.Errorf("a %g byte flame was within the default budget", e.Bytes)
+	}
+}
@@ -0,0 +1,312 @@
+package main
+
+// The sections of the index page
+const (
+	linearGroup    = "Linear self repeating"
+	areaGroup      = "Area subdividing"
+	escapeGroup    = "Escape time"
+	treeGroup      = "Trees"
+	circleGroup    = "Circle packing"
+	landscapeGroup = "Landscapes"
+	dlaGroup       = "Diffusion limited aggregation"
+	ifsGroup       = "Iterated function systems"
+)
+
+// Every fractal the server draws, in the order they are listed
+var (
+	fractals = newFractals()
+)
+
+// Check a palette name or list of colours
+func checkPalette(value string) error {
+	_, err := bandColors(value, 1)
+	return err
+}
+
+// Check a space separated list of points
+func checkPoints(value string) error {
+	_, err := parsePoints(value)
+	return err
+}
+
+// Check a space separated list of complex numbers
+func checkComplexList(value string) error {
+	_, err := parseComplexList(value)
+	return err
+}
+
+// Check a space separated list of IFS maps
+func checkIFSMaps(value string) error {
+	coefficients, err := parseIFSMaps(value)
+	if err == nil {
+		_, err = NewIFS(coefficients)
+	}
+	return err
+}
+
+// Check a JSON flame definition
+func checkFlame(value string) error {
+	_, err := ParseFlame([]byte(value))
+	return err
+}
+
+// The parameter shared by every fractal drawn by recursion
+func complexityParam(defaultValue, max int) Param {
+	return NewIntParam("complexity", defaultValue, 0, max, "recursion depth")
+}
+
+// The random seed, so the same parameters always draw the same picture
+func seedParam() Param {
+	return NewIntParam("seed", 1, -1<<53, 1<<53, "random seed")
+}
+
+func paletteParam(defaultValue string) Param {
+	return NewTextParam("palette", defaultValue, "a palette name (gray, fire, ocean, forest, basins, terrain) or comma separated rrggbb colours").WithCheck(checkPalette)
+}
+
+// The spike shape parameters shared by the koch curve and snowflake
+func kochParams() []Param {
+	return []Param{
+		NewFloatParam("position", 0.5, 0.0, 1.0, "centre of the spike along the segment"),
+		NewFloatParam("width", 1.0/3.0, 0.01, 1.0, "width of the spike base"),
+		NewFloatParam("height", 1.0/3.0, 0.0, 1.0, "height of the spike"),
+		NewFloatParam("apex", 0.5, 0.0, 1.0, "position of the spike tip across its base"),
+		NewChoiceParam("orient", "fixed", []string{"fixed", "alternate", "random"}, "spike direction per level"),
+		NewBoolParam("random", false, "choose the spike direction and perturb its height for every segment"),
+		NewFloatParam("jitter", 0.25, 0.0, 1.0, "how far random heights may vary"),
+		seedParam(),
+	}
+}
+
+// The view shared by the escape time and newton fractals
+func viewParams(cx float64) []Param {
+	return []Param{
+		NewFloatParam("cx", cx, -1e6, 1e6, "real part of the centre of the view"),
+		NewFloatParam("cy", 0.0, -1e6, 1e6, "imaginary part of the centre of the view"),
+		NewFloatParam("zoom", 1.0, 1e-6, 1e12, "magnification, a zoom of 1 shows 4 units across"),
+		NewIntParam("grid", 300, 10, 800, "samples across the image"),
+	}
+}
+
+// The pan and zoom shared by the recursive and turtle drawn curves
+func viewportParams() []Param {
+	return []Param{
+		NewFloatParam("x", 0.5, 0.0, 1.0, "horizontal centre of the view, as a fraction of the unzoomed width"),
+		NewFloatParam("y", 0.5, 0.0, 1.0, "vertical centre of the view, as a fraction of the unzoomed height"),
+		NewFloatParam("zoom", 1.0, 1.0, 1e12, "magnification about the centre of the view"),
+		NewFloatParam("detail", 0.5, 0.1, 100.0, "segments shorter than this many pixels are not subdivided"),
+	}
+}
+
+func escapeParams(julia bool) []Param {
+	cx := -0.5
+	if julia {
+		cx = 0.0
+	}
+	params := append(viewParams(cx),
+		NewIntParam("iterations", 100, 1, 5000, "iteration limit"),
+		NewIntParam("bands", 16, 1, 256, "number of colour bands"),
+		paletteParam("ocean"),
+	)
+	if julia {
+		params = append(params,
+			NewFloatParam("cr", -0.8, -1e6, 1e6, "real part of the julia set constant"),
+			NewFloatParam("ci", 0.156, -1e6, 1e6, "imaginary part of the julia set constant"),
+		)
+	}
+	return params
+}
+
+func landscapeParams(complexity, minComplexity, maxComplexity int) []Param {
+	return []Param{
+		NewIntParam("complexity", complexity, minComplexity, maxComplexity, "recursion depth"),
+		NewFloatParam("hurst", 0.8, 0.0, 1.0, "each level the displacement is scaled by 2^-hurst"),
+		NewFloatParam("roughness", 0.15, 0.0, 1.0, "the first displacement, as a fraction of the width"),
+		seedParam(),
+	}
+}
+
+func spaceFillingFractal(group, name, title, path string, curve *SpaceFillingCurve) *Fractal {
+	return &Fractal{Name: name, Title: title, Path: path, Group: group, ContentType: "image/svg+xml",
+		Params: append([]Param{complexityParam(curve.DefaultComplexity, curve.MaxComplexity)}, viewportParams()...),
+		render: spaceFillingHandler(curve), estimate: spaceFillingEstimate(curve)}
+}
+
+func areaFractalOf(group, name, title, path string, fractal *AreaFractal) *Fractal {
+	return &Fractal{Name: name, Title: title, Path: path, Group: group, ContentType: "image/svg+xml",
+		Params: []Param{complexityParam(fractal.DefaultComplexity, depthLimit(fractal.Pieces, maxAreaPolygons))},
+		render: areaHandler(fractal), estimate: areaEstimate(fractal)}
+}
+
+func tilingFractal(group, name, title, path string, tiling *Tiling) *Fractal {
+	return &Fractal{Name: name, Title: title, Path: path, Group: group, ContentType: "image/svg+xml",
+		Params: []Param{
+			complexityParam(tiling.DefaultComplexity, depthLimit(tiling.Pieces, maxTiles/len(tiling.Start(1.0)))),
+			paletteParam("#f4a582,#92c5de"),
+		},
+		render: tilingHandler(tiling), estimate: tilingEstimate(tiling)}
+}
+
+func newFractals() []*Fractal {
+	treeComplexity := depthLimit(2, maxTreeBranches)
+
+	list := []*Fractal{
+		{Name: "koch-curve", Title: "Koch Curve", Path: "/linear/koch/curve/", Group: linearGroup, ContentType: "image/svg+xml",
+			Params: append([]Param{
+				complexityParam(6, 9),
+				NewFloatParam("pi", 0.5, -1.0, 1.0, "spike angle as a fraction of pi, negative values point down"),
+			}, append(kochParams(), viewportParams()...)...),
+			render: kochCurveHandler, estimate: kochCurveEstimate},
+		{Name: "koch-snowflake", Title: "Koch Snowflake", Path: "/linear/koch/snowflake/", Group: linearGroup, ContentType: "image/svg+xml",
+			Params: append([]Param{complexityParam(5, 8)}, append(kochParams(), viewportParams()...)...),
+			render: kochSnowflakeHandler, estimate: kochSnowflakeEstimate},
+		{Name: "peano-curve", Title: "Peano Curve", Path: "/linear/peano/curve/", Group: linearGroup, ContentType: "image/svg+xml",
+			Params: append([]Param{
+				complexityParam(5, 8),
+				NewFloatParam("height", 1.0/3.0, 0.0, 0.5, "height of the middle segments"),
+				NewBoolParam("center", false, "draw the centre segment"),
+				NewBoolParam("random", false, "perturb the height of every segment"),
+				NewFloatParam("jitter", 0.25, 0.0, 1.0, "how far random heights may vary"),
+				seedParam(),
+			}, viewportParams()...),
+			render: peanoCurveHandler, estimate: peanoCurveEstimate},
+		{Name: "dragon-curve", Title: "Dragon Curve", Path: "/linear/dragon/curve/", Group: linearGroup, ContentType: "image/svg+xml",
+			Params: append([]Param{complexityParam(5, 16)}, viewportParams()...),
+			render: dragonCurveHandler, estimate: dragonCurveEstimate},
+		{Name: "plant1", Title: "Plant", Path: "/linear/plant1/", Group: linearGroup, ContentType: "image/svg+xml",
+			Params: append([]Param{complexityParam(5, 12)}, viewportParams()...),
+			render: plant1Handler, estimate: plant1Estimate},
+		{Name: "generator", Title: "Initiator/Generator Curve", Path: "/linear/generator/", Group: linearGroup, ContentType: "image/svg+xml",
+			Params: []Param{
+				complexityParam(4, 12),
+				NewChoiceParam("preset", "koch", []string{"koch", "snowflake", "cesaro", "levy", "minkowski", "quadratic", "dragon"}, "a built in initiator and generator"),
+				NewTextParam("generator", "", "the motif as points x,y x,y ..., normalised to run from (0,0) to (1,0)").WithCheck(checkPoints),
+				NewTextParam("flags", "", "one character per generator segment, f = flip, r = reverse, b = both"),
+				NewTextParam("initiator", "", "points x,y x,y ... in the unit square").WithCheck(checkPoints),
+				NewBoolParam("closed", false, "close the initiator polygon"),
+			},
+			render: generatorCurveHandler, estimate: generatorCurveEstimate},
+		spaceFillingFractal(linearGroup, "hilbert-curve", "Hilbert Curve", "/linear/hilbert/curve/", hilbertCurve),
+		spaceFillingFractal(linearGroup, "moore-curve", "Moore Curve", "/linear/moore/curve/", mooreCurve),
+		spaceFillingFractal(linearGroup, "peano-serpentine", "Peano Serpentine Curve", "/linear/peano/serpentine/", peanoSerpentine),
+		spaceFillingFractal(linearGroup, "gosper-curve", "Gosper Curve", "/linear/gosper/curve/", gosperCurve),
+		spaceFillingFractal(linearGroup, "sierpinski-curve", "Sierpinski Curve", "/linear/sierpinski/curve/", sierpinskiCurve),
+
+		areaFractalOf(areaGroup, "sierpinski-triangle", "Sierpinski Triangle", "/area/sierpinski/triangle/", sierpinskiTriangle),
+		areaFractalOf(areaGroup, "sierpinski-carpet", "Sierpinski Carpet", "/area/sierpinski/carpet/", sierpinskiCarpet),
+		spaceFillingFractal(areaGroup, "sierpinski-arrowhead", "Sierpinski Arrowhead Curve", "/area/sierpinski/arrowhead/", sierpinskiArrowhead),
+		areaFractalOf(areaGroup, "vicsek-cross", "Vicsek Fractal (cross)", "/area/vicsek/cross/", vicsekCross),
+		areaFractalOf(areaGroup, "vicsek-saltire", "Vicsek Fractal (saltire)", "/area/vicsek/saltire/", vicsekSaltire),
+		tilingFractal(areaGroup, "penrose-kites", "Penrose Kites and Darts", "/area/penrose/kites/", penroseKites),
+		tilingFractal(areaGroup, "penrose-rhombs", "Penrose Rhombs", "/area/penrose/rhombs/", penroseRhombs),
+		tilingFractal(areaGroup, "pinwheel", "Pinwheel Tiling", "/area/pinwheel/", pinwheel),
+
+		{Name: "mandelbrot", Title: "Mandelbrot Set", Path: "/escape/mandelbrot/", Group: escapeGroup, ContentType: "image/svg+xml",
+			Params: escapeParams(false),
+			render: escapeHandler(false), estimate: escapeEstimate},
+		{Name: "julia", Title: "Julia Set", Path: "/escape/julia/", Group: escapeGroup, ContentType: "image/svg+xml",
+			Params: escapeParams(true),
+			render: escapeHandler(true), estimate: escapeEstimate},
+		{Name: "newton", Title: "Newton Fractal", Path: "/newton/", Group: escapeGroup, ContentType: "image/svg+xml or image/png",
+			Params: append(viewParams(0.0),
+				NewTextParam("roots", "1 -0.5,0.8660254 -0.5,-0.8660254", "the roots of the polynomial as re,im ...").WithCheck(checkComplexList),
+				NewTextParam("coefficients", "", "the coefficients of the polynomial as re,im ..., from the highest power down, used instead of roots").WithCheck(checkComplexList),
+				NewIntParam("iterations", 50, 1, 1000, "iteration limit"),
+				paletteParam("basins"),
+				NewBoolParam("shade", true, "darken slowly converging points"),
+				NewChoiceParam("format", "svg", []string{"svg", "svgz", "png"}, "image format, svgz being gzipped svg"),
+			),
+			render: newtonHandler, estimate: newtonEstimate},
+
+		{Name: "pythagoras-tree", Title: "Pythagoras Tree", Path: "/tree/pythagoras/", Group: treeGroup, ContentType: "image/svg+xml",
+			Params: []Param{
+				complexityParam(10, treeComplexity),
+				NewFloatParam("angle", 45.0, 1.0, 89.0, "angle of the left branch in degrees"),
+			},
+			render: pythagorasTreeHandler, estimate: pythagorasTreeEstimate},
+		{Name: "binary-tree", Title: "Binary Tree", Path: "/tree/binary/", Group: treeGroup, ContentType: "image/svg+xml",
+			Params: []Param{
+				complexityParam(10, treeComplexity),
+				NewFloatParam("angle", 25.0, 0.0, 180.0, "angle between each branch and its parent in degrees"),
+				NewFloatParam("length", 0.75, 0.1, 1.0, "per level decay of branch length"),
+				NewFloatParam("spread", 1.0, 0.1, 2.0, "per level decay of branch angle"),
+				NewFloatParam("thickness", 0.1, 0.0, 1.0, "trunk thickness as a fraction of its length"),
+				NewFloatParam("thinning", 0.7, 0.1, 1.0, "per level decay of branch thickness"),
+			},
+			render: binaryTreeHandler, estimate: branchEstimate},
+		{Name: "h-tree", Title: "H-Tree", Path: "/tree/h/", Group: treeGroup, ContentType: "image/svg+xml",
+			Params: []Param{complexityParam(8, treeComplexity)},
+			render: hTreeHandler, estimate: branchEstimate},
+
+		{Name: "apollonian-gasket", Title: "Apollonian Gasket", Path: "/circles/apollonian/", Group: circleGroup, ContentType: "image/svg+xml",
+			Params: []Param{
+				NewFloatParam("k1", 1.0, 1e-6, 1e6, "curvature of the first starting circle"),
+				NewFloatParam("k2", 1.0, 1e-6, 1e6, "curvature of the second starting circle"),
+				NewFloatParam("k3", 1.0, 1e-6, 1e6, "curvature of the third starting circle"),
+				NewFloatParam("min", 0.002, 0.0005, 1.0, "smallest circle drawn, as a fraction of the enclosing circle"),
+			},
+			render: apollonianHandler, estimate: apollonianEstimate},
+		{Name: "pappus-chain", Title: "Pappus Chain", Path: "/circles/pappus/", Group: circleGroup, ContentType: "image/svg+xml",
+			Params: []Param{
+				NewFloatParam("ratio", 2.0/3.0, 0.01, 0.99, "diameter of the inner circle"),
+				NewFloatParam("min", 0.002, 0.0005, 1.0, "smallest circle drawn, as a fraction of the enclosing circle"),
+			},
+			render: pappusHandler, estimate: pappusEstimate},
+
+		{Name: "ridgeline", Title: "Mountain Ridgelines", Path: "/landscape/ridgeline/", Group: landscapeGroup, ContentType: "image/svg+xml",
+			Params: append(landscapeParams(8, 0, 14),
+				NewIntParam("layers", 4, 1, 16, "number of ridgelines"),
+				paletteParam("#a0b0c8,#203040"),
+			),
+			render: ridgelineHandler, estimate: ridgelineEstimate},
+		{Name: "heightmap", Title: "Heightmap Contours", Path: "/landscape/heightmap/", Group: landscapeGroup, ContentType: "image/svg+xml",
+			Params: append(landscapeParams(7, 1, 9),
+				NewFloatParam("interval", 0.02, 0.001, 1.0, "height between contours, as a fraction of the width"),
+				paletteParam("terrain"),
+			),
+			render: heightmapHandler, estimate: heightmapEstimate},
+
+		{Name: "dla", Title: "Diffusion Limited Aggregation", Path: "/dla/", Group: dlaGroup, ContentType: "image/svg+xml",
+			Params: []Param{
+				NewIntParam("particles", 3000, 1, 50000, "number of particles"),
+				NewFloatParam("stickiness", 1.0, 0.01, 1.0, "chance a walker sticks on touching the cluster"),
+				NewBoolParam("lattice", false, "walk on a square lattice rather than in continuous space"),
+				NewFloatParam("budget", 2.0, 0.1, 10.0, "seconds the simulation may run before drawing what it has"),
+				seedParam(),
+				paletteParam("ocean"),
+			},
+			render: dlaHandler, estimate: dlaEstimate},
+		{Name: "flame", Title: "Fractal Flame", Path: "/flame/", Group: ifsGroup, ContentType: "image/png",
+			Params: []Param{
+				NewChoiceParam("preset", "sierpinski", []string{"sierpinski", "swirl", "heart"}, "a built in flame"),
+				NewTextParam("flame", "", "a JSON flame definition, used instead of the preset").WithCheck(checkFlame),
+				seedParam(),
+			},
+			render: flameHandler, estimate: flameEstimate},
+		{Name: "ifs", Title: "Iterated Function System", Path: "/ifs/", Group: ifsGroup, ContentType: "image/svg+xml",
+			Params: []Param{
+				NewChoiceParam("preset", "fern", []string{"fern", "sierpinski", "carpet", "dragon", "levy", "koch", "tree"}, "a built in system"),
+				NewTextParam("maps", "", "affine maps a,b,c,d,e,f[,p] ..., sending (x,y) to (ax+by+e, cx+dy+f) with probability p").WithCheck(checkIFSMaps),
+				NewChoiceParam("mode", "chaos", []string{"chaos", "recursive"}, "render with the chaos game or by recursion"),
+				NewIntParam("points", 50000, 0, 1000000, "number of chaos game points"),
+				complexityParam(6, 16),
+				seedParam(),
+			},
+			render: ifsHandler, estimate: ifsEstimate},
+	}
+
+	names := make(map[string]bool)
+	for _, f := range list {
+		if names[f.Name] {
+			panic("Fractal registered twice " + f.Name)
+		}
+		if f.estimate == nil {
+			panic("Fractal has no estimate " + f.Name)
+		}
+		if f.ContentType == "image/svg+xml" {
+			f.Params = append(f.Params, NewChoiceParam("format", "svg", []string{"svg", "svgz"}, "image format, svgz being gzipped svg"))
+		}
+		names[f.Name] = true
+	}
+	return list
+}
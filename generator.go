@@ -0,0 +1,273 @@
+package main
+
+import (
+	"errors"
+	"github.com/ajstarks/svgo"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Upper bound on the number of line segments an initiator/generator curve draws
+const maxGeneratorSegments = 1 << 20
+
+// A generator motif for the initiator/generator engine.
+//
+// The motif is a polyline that runs from (0, 0) to (1, 0), with y pointing away
+// from the left hand side of the segment being replaced.  Each segment of the
+// motif may be flipped (mirrored across itself) and/or reversed (drawn from its
+// end back to its start) when it is replaced at the next level.
+type Generator struct {
+	Points  []Point
+	Flip    []bool
+	Reverse []bool
+}
+
+// A named initiator/generator pair
+type GeneratorPreset struct {
+	Initiator []Point
+	Closed    bool
+	Generator *Generator
+}
+
+// Create a new generator from a set of points, with no flipped or reversed segments
+func NewGenerator(points []Point) *Generator {
+	segments := 0
+	if len(points) > 1 {
+		segments = len(points) - 1
+	}
+	return &Generator{Points: points, Flip: make([]bool, segments), Reverse: make([]bool, segments)}
+}
+
+// The number of segments each segment is replaced with
+func (g *Generator) Segments() int {
+	return len(g.Points) - 1
+}
+
+// Move and scale the motif so that it runs from (0, 0) to (1, 0)
+func (g *Generator) Normalise() error {
+	if len(g.Points) < 2 {
+		return errors.New("a generator needs at least two points")
+	}
+	start, end := g.Points[0], g.Points[len(g.Points)-1]
+	l := NewLine3(start, end)
+	length := l.Length()
+	if length == 0.0 {
+		return errors.New("a generator must not start and end at the same point")
+	}
+	dx, dy := l.Direction.X/length, l.Direction.Y/length
+	for i, p := range g.Points {
+		x, y := p.X-start.X, p.Y-start.Y
+		g.Points[i] = Point{X: (x*dx + y*dy) / length, Y: (y*dx - x*dy) / length}
+	}
+	return nil
+}
+
+// Map a point of the motif onto the line l
+func (g *Generator) mapPoint(l Line, p Point, flip bool) Point {
+	d := Vector{Point{X: l.Direction.X * l.Scale, Y: l.Direction.Y * l.Scale}}
+	perp := cross(d)
+	y := p.Y
+	if flip {
+		y = -y
+	}
+	return Point{X: l.Start.X + p.X*d.X + y*perp.X, Y: l.Start.Y + p.X*d.Y + y*perp.Y}
+}
+
+// Do the fractal
+func doGeneratorCurve(s *svg.SVG, l Line, gen *Generator, depth int, flip bool) {
+	if depth <= 0 {
+		l.Render(s)
+		return
+	}
+	prev := gen.mapPoint(l, gen.Points[0], flip)
+	for i := 1; i < len(gen.Points); i++ {
+		next := gen.mapPoint(l, gen.Points[i], flip)
+		segment := NewLine3(prev, next)
+		if gen.Reverse[i-1] {
+			segment = NewLine3(next, prev)
+		}
+		doGeneratorCurve(s, segment, gen, depth-1, flip != gen.Flip[i-1])
+		prev = next
+	}
+}
+
+// Apply the generator to each edge of the initiator
+func generatorCurve(s *svg.SVG, initiator []Point, closed bool, gen *Generator, complexity int) {
+	for i := 1; i < len(initiator); i++ {
+		doGeneratorCurve(s, NewLine3(initiator[i-1], initiator[i]), gen, complexity, false)
+	}
+	if closed && len(initiator) > 2 {
+		doGeneratorCurve(s, NewLine3(initiator[len(initiator)-1], initiator[0]), gen, complexity, false)
+	}
+}
+
+// Parse a space separated list of points in the form "x1,y1 x2,y2 ..."
+func parsePoints(value string) ([]Point, error) {
+	var points []Point
+	for _, pair := range strings.Fields(value) {
+		coords := strings.Split(pair, ",")
+		if len(coords) != 2 {
+			return nil, errors.New("invalid point " + pair)
+		}
+		x, err := strconv.ParseFloat(strings.TrimSpace(coords[0]), 64)
+		if err != nil {
+			return nil, err
+		}
+		y, err := strconv.ParseFloat(strings.TrimSpace(coords[1]), 64)
+		if err != nil {
+			return nil, err
+		}
+		points = append(points, Point{X: x, Y: y})
+	}
+	return points, nil
+}
+
+// Parse the per segment flags of a generator, one character per segment.
+// 'f' flips the segment, 'r' reverses it, 'b' does both, anything else leaves it alone.
+func (g *Generator) parseFlags(flags string) {
+	for i := 0; i < len(flags) && i < g.Segments(); i++ {
+		switch flags[i] {
+		case 'f':
+			g.Flip[i] = true
+		case 'r':
+			g.Reverse[i] = true
+		case 'b':
+			g.Flip[i] = true
+			g.Reverse[i] = true
+		}
+	}
+}
+
+// The initiators, in a unit square with y pointing down the canvas
+var (
+	lineInitiator     = []Point{{X: 0.0, Y: 0.6}, {X: 1.0, Y: 0.6}}
+	triangleInitiator = []Point{{X: 0.2, Y: 0.3}, {X: 0.8, Y: 0.3}, {X: 0.5, Y: 0.3 + 0.6*math.Sqrt(3.0)/2.0}}
+	squareInitiator   = []Point{{X: 0.2, Y: 0.2}, {X: 0.8, Y: 0.2}, {X: 0.8, Y: 0.8}, {X: 0.2, Y: 0.8}}
+)
+
+// Build a Koch style generator with a spike of the given angle (in radians)
+func spikeGenerator(angle float64) *Generator {
+	r := 1.0 / (2.0 + 2.0*math.Cos(angle))
+	return NewGenerator([]Point{{X: 0.0, Y: 0.0}, {X: r, Y: 0.0}, {X: 0.5, Y: r * math.Sin(angle)}, {X: 1.0 - r, Y: 0.0}, {X: 1.0, Y: 0.0}})
+}
+
+func newGeneratorPresets() map[string]*GeneratorPreset {
+	presets := make(map[string]*GeneratorPreset)
+
+	presets["koch"] = &GeneratorPreset{Initiator: lineInitiator, Generator: spikeGenerator(math.Pi / 3.0)}
+	presets["snowflake"] = &GeneratorPreset{Initiator: triangleInitiator, Closed: true, Generator: spikeGenerator(math.Pi / 3.0)}
+
+	// the spikes point into the square, giving the torn square
+	cesaro := spikeGenerator(85.0 * math.Pi / 180.0)
+	for i := range cesaro.Points {
+		cesaro.Points[i].Y = -cesaro.Points[i].Y
+	}
+	presets["cesaro"] = &GeneratorPreset{Initiator: squareInitiator, Closed: true, Generator: cesaro}
+
+	presets["levy"] = &GeneratorPreset{Initiator: []Point{{X: 0.25, Y: 0.65}, {X: 0.75, Y: 0.65}},
+		Generator: NewGenerator([]Point{{X: 0.0, Y: 0.0}, {X: 0.5, Y: 0.5}, {X: 1.0, Y: 0.0}})}
+
+	presets["minkowski"] = &GeneratorPreset{Initiator: lineInitiator,
+		Generator: NewGenerator([]Point{{X: 0.0, Y: 0.0}, {X: 0.25, Y: 0.0}, {X: 0.25, Y: 0.25}, {X: 0.5, Y: 0.25},
+			{X: 0.5, Y: 0.0}, {X: 0.5, Y: -0.25}, {X: 0.75, Y: -0.25}, {X: 0.75, Y: 0.0}, {X: 1.0, Y: 0.0}})}
+
+	presets["quadratic"] = &GeneratorPreset{Initiator: squareInitiator, Closed: true,
+		Generator: NewGenerator([]Point{{X: 0.0, Y: 0.0}, {X: 1.0 / 3.0, Y: 0.0}, {X: 1.0 / 3.0, Y: 1.0 / 3.0},
+			{X: 2.0 / 3.0, Y: 1.0 / 3.0}, {X: 2.0 / 3.0, Y: 0.0}, {X: 1.0, Y: 0.0}})}
+
+	// the Heighway dragon expressed as a generator, the second segment is flipped
+	dragon := NewGenerator([]Point{{X: 0.0, Y: 0.0}, {X: 0.5, Y: 0.5}, {X: 1.0, Y: 0.0}})
+	dragon.Flip[1] = true
+	presets["dragon"] = &GeneratorPreset{Initiator: []Point{{X: 0.25, Y: 0.5}, {X: 0.75, Y: 0.5}}, Generator: dragon}
+
+	return presets
+}
+
+var (
+	generatorPresets = newGeneratorPresets()
+)
+
+// Return the initiator and generator given by the values, or the name of the parameter
+// at fault and what is wrong with it
+func generatorOf(v Values) (initiator []Point, closed bool, gen *Generator, field string, err error) {
+	preset := generatorPresets[v.String("preset")]
+	initiator = preset.Initiator
+	closed = preset.Closed
+	gen = preset.Generator
+
+	if value := v.String("generator"); value != "" {
+		points, err := parsePoints(value)
+		if err == nil {
+			gen = NewGenerator(points)
+			err = gen.Normalise()
+		}
+		if err != nil {
+			return nil, false, nil, "generator", err
+		}
+		gen.parseFlags(v.String("flags"))
+	}
+
+	if value := v.String("initiator"); value != "" {
+		if initiator, err = parsePoints(value); err != nil || len(initiator) < 2 {
+			return nil, false, nil, "initiator", errors.New("need at least two points")
+		}
+		closed = v.Bool("closed")
+	}
+	return initiator, closed, gen, "", nil
+}
+
+// Return the recursion depth, up to complexity, at which the curve draws at most
+// maxGeneratorSegments, and the number of segments it draws
+func generatorDepth(initiator []Point, closed bool, gen *Generator, complexity int) (int, int) {
+	edges := len(initiator) - 1
+	if closed && len(initiator) > 2 {
+		edges++
+	}
+	segments := edges
+	for i := 0; i < complexity; i++ {
+		if segments*gen.Segments() > maxGeneratorSegments {
+			return i, segments
+		}
+		segments *= gen.Segments()
+	}
+	return complexity, segments
+}
+
+func generatorCurveHandler(w http.ResponseWriter, req *http.Request, v Values) {
+	maxComplexity := int(v.Max("complexity"))
+
+	initiator, closed, gen, field, err := generatorOf(v)
+	if err != nil {
+		paramError(w, field, err)
+		return
+	}
+	complexity, _ := generatorDepth(initiator, closed, gen, v.Int("complexity"))
+
+	w.Header().Set("Content-Type", "image/svg+xml")
+	s := svg.New(w)
+	width := 1000 + (4000 * complexity / maxComplexity)
+	height := width
+
+	view := NewMatrix()
+	view.Scale(float64(width), float64(height))
+	scaled := make([]Point, len(initiator))
+	for i, p := range initiator {
+		scaled[i] = view.Apply(p)
+	}
+
+	s.Start(width, height)
+	defer s.End()
+
+	generatorCurve(s, scaled, closed, gen, complexity)
+}
+
+func generatorCurveEstimate(v Values) Estimate {
+	initiator, closed, gen, _, err := generatorOf(v)
+	if err != nil {
+		return Estimate{}
+	}
+	_, segments := generatorDepth(initiator, closed, gen, v.Int("complexity"))
+	return lineEstimate(float64(segments))
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"errors"
+	"github.com/ajstarks/svgo"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Upper bound on the number of polygons drawn by the recursive renderer
+const maxIFSPolygons = 1 << 16
+
+// One affine map of an iterated function system, along with the
+// probability of the chaos game choosing it
+type IFSMap struct {
+	Transform   *Matrix
+	Probability float64
+}
+
+// An iterated function system
+type IFS struct {
+	Maps []IFSMap
+}
+
+// Create an iterated function system from rows of (a, b, c, d, e, f, p) coefficients,
+// where each map sends (x, y) to (a*x + b*y + e, c*x + d*y + f) and is chosen with
+// probability p.  If p is left off, it is weighted by the area the map covers.
+func NewIFS(coefficients [][]float64) (*IFS, error) {
+	if len(coefficients) == 0 {
+		return nil, errors.New("an IFS needs at least one map")
+	}
+	sys := &IFS{Maps: make([]IFSMap, len(coefficients))}
+	stretch := make([]float64, len(coefficients))
+	total := 0.0
+	for i, c := range coefficients {
+		if len(c) != 6 && len(c) != 7 {
+			return nil, errors.New("each map needs 6 or 7 coefficients")
+		}
+		m := NewAffineMatrix(c[0], c[1], c[2], c[3], c[4], c[5])
+		p := math.Abs(m.Determinant())
+		if len(c) == 7 {
+			p = c[6]
+		}
+		if p < 0.0 {
+			return nil, errors.New("probabilities must not be negative")
+		}
+		// degenerate maps still need a small chance of being chosen
+		if p == 0.0 {
+			p = 0.01
+		}
+		sys.Maps[i] = IFSMap{Transform: m, Probability: p}
+		stretch[i] = largestStretch(c[0], c[1], c[2], c[3])
+		total += p
+	}
+	contraction := 0.0
+	for i := range sys.Maps {
+		sys.Maps[i].Probability /= total
+		contraction += sys.Maps[i].Probability * math.Log(stretch[i])
+	}
+
+	// maps that don't shrink the plane on average scatter the chaos game off to
+	// infinity, and ones that shrink it to a point leave nothing to draw
+	if contraction >= 0.0 {
+		return nil, errors.New("the maps must shrink the plane, their attractor is unbounded")
+	}
+	low, high := sys.Bounds()
+	extent := math.Max(high.X-low.X, high.Y-low.Y)
+	if math.IsNaN(extent) || math.IsInf(extent, 0) {
+		return nil, errors.New("the maps must shrink the plane, their attractor is unbounded")
+	}
+	if extent == 0.0 {
+		return nil, errors.New("the attractor of the maps is a single point")
+	}
+	return sys, nil
+}
+
+// Return the most the linear map (a, b, c, d) stretches any vector, its largest
+// singular value
+func largestStretch(a, b, c, d float64) float64 {
+	sum := a*a + b*b + c*c + d*d
+	det := a*d - b*c
+	return math.Sqrt((sum + math.Sqrt(math.Max(sum*sum-4*det*det, 0.0))) / 2.0)
+}
+
+// Pick a map at random, weighted by the map probabilities
+func (sys *IFS) choose(rnd *rand.Rand) *Matrix {
+	r := rnd.Float64()
+	for i := range sys.Maps {
+		r -= sys.Maps[i].Probability
+		if r <= 0.0 {
+			return sys.Maps[i].Transform
+		}
+	}
+	return sys.Maps[len(sys.Maps)-1].Transform
+}
+
+// Play the chaos game for the given number of points, calling plot for each point.
+// The first few points are dropped while the orbit settles onto the attractor.
+func (sys *IFS) ChaosGame(points int, rnd *rand.Rand, plot func(Point)) {
+	const settle = 20
+
+	p := Point{}
+	for i := 0; i < points+settle; i++ {
+		p = MultMatrixPoint(sys.choose(rnd), p)
+		if i >= settle {
+			plot(p)
+		}
+	}
+}
+
+// Estimate the bounding box of the attractor
+func (sys *IFS) Bounds() (low, high Point) {
+	const samples = 5000
+
+	low = Point{X: math.Inf(1), Y: math.Inf(1)}
+	high = Point{X: math.Inf(-1), Y: math.Inf(-1)}
+	sys.ChaosGame(samples, rand.New(rand.NewSource(1)), func(p Point) {
+		low.X, low.Y = math.Min(low.X, p.X), math.Min(low.Y, p.Y)
+		high.X, high.Y = math.Max(high.X, p.X), math.Max(high.Y, p.Y)
+	})
+	return low, high
+}
+
+// Do the fractal, applying each map to the polygon until depth runs out
+func doIFSPolygon(s *svg.SVG, sys *IFS, polygon []Point, depth int, view *Matrix) {
+	if depth <= 0 {
+		x := make([]int, len(polygon))
+		y := make([]int, len(polygon))
+		for i, p := range polygon {
+			p = MultMatrixPoint(view, p)
+			x[i], y[i] = int(p.X), int(p.Y)
+		}
+		s.Polygon(x, y, "fill:black;stroke:none")
+		return
+	}
+	for i := range sys.Maps {
+		next := make([]Point, len(polygon))
+		for j, p := range polygon {
+			next[j] = MultMatrixPoint(sys.Maps[i].Transform, p)
+		}
+		doIFSPolygon(s, sys, next, depth-1, view)
+	}
+}
+
+// Render the attractor with the chaos game, plotting at most one dot per pixel
+func ifsChaos(s *svg.SVG, sys *IFS, width, height, points int, view *Matrix, rnd *rand.Rand) {
+	plotted := make([]bool, width*height)
+	sys.ChaosGame(points, rnd, func(p Point) {
+		p = MultMatrixPoint(view, p)
+		x, y := int(p.X), int(p.Y)
+		if x < 0 || y < 0 || x >= width || y >= height || plotted[y*width+x] {
+			return
+		}
+		plotted[y*width+x] = true
+		s.Rect(x, y, 1, 1, "fill:black;stroke:none")
+	})
+}
+
+// Render the attractor by recursively mapping its bounding box
+func ifsRecursive(s *svg.SVG, sys *IFS, low, high Point, depth int, view *Matrix) {
+	box := []Point{{X: low.X, Y: low.Y}, {X: high.X, Y: low.Y}, {X: high.X, Y: high.Y}, {X: low.X, Y: high.Y}}
+	doIFSPolygon(s, sys, box, depth, view)
+}
+
+// Parse a space separated list of maps, each a comma separated list of coefficients
+func parseIFSMaps(value string) ([][]float64, error) {
+	var maps [][]float64
+	for _, m := range strings.Fields(value) {
+		var coefficients []float64
+		for _, c := range strings.Split(m, ",") {
+			f, err := strconv.ParseFloat(strings.TrimSpace(c), 64)
+			if err != nil {
+				return nil, err
+			}
+			if math.IsNaN(f) || math.IsInf(f, 0) {
+				return nil, errors.New("coefficients must be finite numbers")
+			}
+			coefficients = append(coefficients, f)
+		}
+		maps = append(maps, coefficients)
+	}
+	return maps, nil
+}
+
+func newIFSPresets() map[string]*IFS {
+	r3 := math.Sqrt(3.0) / 6.0
+	carpet := [][]float64{}
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			if i != 1 || j != 1 {
+				carpet = append(carpet, []float64{1.0 / 3.0, 0.0, 0.0, 1.0 / 3.0, float64(i) / 3.0, float64(j) / 3.0})
+			}
+		}
+	}
+
+	coefficients := map[string][][]float64{
+		"fern": {
+			{0.0, 0.0, 0.0, 0.16, 0.0, 0.0, 0.01},
+			{0.85, 0.04, -0.04, 0.85, 0.0, 1.6, 0.85},
+			{0.2, -0.26, 0.23, 0.22, 0.0, 1.6, 0.07},
+			{-0.15, 0.28, 0.26, 0.24, 0.0, 0.44, 0.07},
+		},
+		"sierpinski": {
+			{0.5, 0.0, 0.0, 0.5, 0.0, 0.0},
+			{0.5, 0.0, 0.0, 0.5, 0.5, 0.0},
+			{0.5, 0.0, 0.0, 0.5, 0.25, math.Sqrt(3.0) / 4.0},
+		},
+		"carpet": carpet,
+		"dragon": {
+			{0.5, -0.5, 0.5, 0.5, 0.0, 0.0},
+			{-0.5, -0.5, 0.5, -0.5, 1.0, 0.0},
+		},
+		"levy": {
+			{0.5, -0.5, 0.5, 0.5, 0.0, 0.0},
+			{0.5, 0.5, -0.5, 0.5, 0.5, 0.5},
+		},
+		"koch": {
+			{1.0 / 3.0, 0.0, 0.0, 1.0 / 3.0, 0.0, 0.0},
+			{1.0 / 6.0, -r3, r3, 1.0 / 6.0, 1.0 / 3.0, 0.0},
+			{1.0 / 6.0, r3, -r3, 1.0 / 6.0, 0.5, r3},
+			{1.0 / 3.0, 0.0, 0.0, 1.0 / 3.0, 2.0 / 3.0, 0.0},
+		},
+		"tree": {
+			{0.0, 0.0, 0.0, 0.5, 0.0, 0.0, 0.05},
+			{0.42, -0.42, 0.42, 0.42, 0.0, 0.2, 0.4},
+			{0.42, 0.42, -0.42, 0.42, 0.0, 0.2, 0.4},
+			{0.1, 0.0, 0.0, 0.1, 0.0, 0.2, 0.15},
+		},
+	}
+
+	presets := make(map[string]*IFS)
+	for name, c := range coefficients {
+		sys, err := NewIFS(c)
+		if err != nil {
+			panic("Invalid IFS preset " + name + " " + err.Error())
+		}
+		presets[name] = sys
+	}
+	return presets
+}
+
+var (
+	ifsPresets = newIFSPresets()
+)
+
+// Return the system given by the preset or maps parameters
+func ifsOf(v Values) (*IFS, error) {
+	sys := ifsPresets[v.String("preset")]
+	if value := v.String("maps"); value != "" {
+		coefficients, err := parseIFSMaps(value)
+		if err == nil {
+			sys, err = NewIFS(coefficients)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return sys, nil
+}
+
+// Return the recursion depth, up to complexity, at which the recursive renderer draws
+// at most maxIFSPolygons, and the number of polygons it draws
+func ifsDepth(sys *IFS, complexity int) (int, int) {
+	polygons := 1
+	for i := 0; i < complexity; i++ {
+		if polygons*len(sys.Maps) > maxIFSPolygons {
+			return i, polygons
+		}
+		polygons *= len(sys.Maps)
+	}
+	return complexity, polygons
+}
+
+func ifsHandler(w http.ResponseWriter, req *http.Request, v Values) {
+	const (
+		width  = 1000
+		margin = 20
+	)
+
+	sys, err := ifsOf(v)
+	if err != nil {
+		paramError(w, "maps", err)
+		return
+	}
+
+	recursive := v.String("mode") == "recursive"
+	complexity, _ := ifsDepth(sys, v.Int("complexity"))
+
+	// fit the attractor to the canvas, flipping y so it is drawn the right way up
+	low, high := sys.Bounds()
+	scale := float64(width-2*margin) / math.Max(high.X-low.X, high.Y-low.Y)
+	height := int((high.Y-low.Y)*scale) + 2*margin
+	view := NewAffineMatrix(scale, 0.0, 0.0, -scale, margin-low.X*scale, float64(height-margin)+low.Y*scale)
+
+	w.Header().Set("Content-Type", "image/svg+xml")
+	s := svg.New(w)
+	s.Start(width, height)
+	defer s.End()
+
+	if recursive {
+		ifsRecursive(s, sys, low, high, complexity, view)
+	} else {
+		ifsChaos(s, sys, width, height, v.Int("points"), view, seededRand(v))
+	}
+}
+
+// The chaos game plots at most one dot per pixel of the canvas, which is at most as
+// high as it is wide
+func ifsEstimate(v Values) Estimate {
+	const width = 1000
+
+	sys, err := ifsOf(v)
+	if err != nil {
+		return Estimate{}
+	}
+	if v.String("mode") == "recursive" {
+		_, polygons := ifsDepth(sys, v.Int("complexity"))
+		return polygonEstimate(float64(polygons), 4)
+	}
+	return dotEstimate(math.Min(float64(v.Int("points")), width*width))
+}
@@ -0,0 +1,29 @@
+package main
+
+import "testing"
+
+func TestNewIFSRejectsUnboundedMaps(t *testing.T) {
+	for _, maps := range []string{
+		"2,0,0,2,1,1",
+		"1.01,0,0,1.01,1,1",
+		"0,-1,1,0,0,0",
+		"0,0,0,0,1,1",
+		"NaN,0,0,0.5,0,0",
+		"0.5,0,0,0.5,Inf,0",
+	} {
+		if err := checkIFSMaps(maps); err == nil {
+			t.Errorf("maps %s were accepted", maps)
+		}
+	}
+}
+
+func TestNewIFSPresets(t *testing.T) {
+	for name, sys := range ifsPresets {
+		if sys == nil {
+			t.Errorf("preset %s was not created", name)
+		}
+	}
+	if err := checkIFSMaps("0.5,0,0,0.5,0,0 0.5,0,0,0.5,1,0"); err != nil {
+		t.Errorf("a cantor set was rejected: %v", err)
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"github.com/ajstarks/svgo"
+	"math"
+	"math/rand"
+	"net/http"
+)
+
+// Upper bound on the number of contours a heightmap draws
+const maxContours = 256
+
+// The shape of a midpoint displacement landscape.  Each level of recursion the
+// random displacement is scaled by 2^-Hurst, so a low exponent gives rough terrain.
+type LandscapeOptions struct {
+	Hurst     float64
+	Roughness float64 // the first displacement, as a fraction of the width
+}
+
+// Do the fractal, move the midpoint of l up or down by a random amount then
+// displace each half with a smaller amount.  The points after the start of l are
+// appended in order.
+func doRidgeline(points []Point, l Line, displacement float64, options *LandscapeOptions, depth int, rnd *rand.Rand) []Point {
+	if depth <= 0 {
+		return append(points, l.At(1.0))
+	}
+	left, right := l.Split(0.5)
+	mid := right.Start
+	mid.Y += rnd.NormFloat64() * displacement
+
+	displacement *= math.Pow(2.0, -options.Hurst)
+	points = doRidgeline(points, NewLine3(left.Start, mid), displacement, options, depth-1, rnd)
+	return doRidgeline(points, NewLine3(mid, right.At(1.0)), displacement, options, depth-1, rnd)
+}
+
+// Return a ridgeline running across l, with 2^depth segments
+func ridgeline(l Line, options *LandscapeOptions, depth int, rnd *rand.Rand) []Point {
+	points := []Point{l.Start}
+	return doRidgeline(points, l, options.Roughness*l.Length(), options, depth, rnd)
+}
+
+// Draw layers of mountains, the furthest first, each filled down to the bottom of
+// the canvas and coloured along the palette from back to front
+func mountains(s *svg.SVG, options *LandscapeOptions, layers, depth, size int, colors []string, rnd *rand.Rand) {
+	for i := 0; i < layers; i++ {
+		y := float64(size) * (0.3 + 0.5*float64(i)/float64(layers))
+		points := ridgeline(NewLine(0.0, y, float64(size), y), options, depth, rnd)
+		points = append(points, Point{X: float64(size), Y: float64(size)}, Point{X: 0.0, Y: float64(size)})
+		renderPolygon(s, points, "stroke:none;fill:"+colors[i])
+	}
+}
+
+// Build a (2^depth + 1) square heightmap with the diamond-square algorithm
+func diamondSquare(options *LandscapeOptions, depth int, rnd *rand.Rand) [][]float64 {
+	n := 1 << uint(depth)
+	field := make([][]float64, n+1)
+	for y := range field {
+		field[y] = make([]float64, n+1)
+	}
+	// heights are fractions of the width of the map
+	displacement := options.Roughness
+	for _, c := range [][2]int{{0, 0}, {n, 0}, {0, n}, {n, n}} {
+		field[c[1]][c[0]] = rnd.NormFloat64() * displacement
+	}
+
+	for step := n; step > 1; step /= 2 {
+		half := step / 2
+		displacement *= math.Pow(2.0, -options.Hurst)
+
+		// diamond step, the centre of each square is the mean of its corners
+		for y := half; y < n; y += step {
+			for x := half; x < n; x += step {
+				mean := (field[y-half][x-half] + field[y-half][x+half] + field[y+half][x-half] + field[y+half][x+half]) / 4.0
+				field[y][x] = mean + rnd.NormFloat64()*displacement
+			}
+		}
+
+		// square step, the centre of each edge is the mean of its neighbours
+		for y := 0; y <= n; y += half {
+			for x := (y/half + 1) % 2 * half; x <= n; x += step {
+				sum, count := 0.0, 0
+				for _, d := range [][2]int{{-half, 0}, {half, 0}, {0, -half}, {0, half}} {
+					nx, ny := x+d[0], y+d[1]
+					if nx >= 0 && nx <= n && ny >= 0 && ny <= n {
+						sum += field[ny][nx]
+						count++
+					}
+				}
+				field[y][x] = sum/float64(count) + rnd.NormFloat64()*displacement
+			}
+		}
+	}
+	return field
+}
+
+// Draw a heightmap as filled bands between contours spaced interval apart, with
+// the contour lines stroked on top.  Heights are fractions of the map's width.
+func heightmap(s *svg.SVG, field [][]float64, interval float64, palette string, size int) error {
+	low, high := math.Inf(1), math.Inf(-1)
+	for _, row := range field {
+		for _, v := range row {
+			low, high = math.Min(low, v), math.Max(high, v)
+		}
+	}
+	if (high-low)/interval > maxContours {
+		interval = (high - low) / maxContours
+	}
+	first := math.Ceil(low/interval) * interval
+	count := int((high-first)/interval) + 1
+
+	colors, err := bandColors(palette, count+1)
+	if err != nil {
+		return err
+	}
+
+	view := NewMatrix()
+	view.Scale(float64(size)/float64(len(field)-1), float64(size)/float64(len(field)-1))
+
+	s.Rect(0, 0, size, size, "fill:"+colors[0])
+	for i := 0; i < count; i++ {
+		level := first + float64(i)*interval
+		renderContourRegion(s, field, level, view, "stroke:#404040;stroke-width:0.5;fill:"+colors[i+1])
+	}
+	return nil
+}
+
+// Return the hurst exponent and roughness shared by the landscapes
+func landscapeOptions(v Values) *LandscapeOptions {
+	return &LandscapeOptions{Hurst: v.Float("hurst"), Roughness: v.Float("roughness")}
+}
+
+func ridgelineHandler(w http.ResponseWriter, req *http.Request, v Values) {
+	const size = 1000
+
+	layers := v.Int("layers")
+	colors, err := bandColors(v.String("palette"), layers)
+	if err != nil {
+		paramError(w, "palette", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/svg+xml")
+	s := svg.New(w)
+	s.Start(size, size)
+	defer s.End()
+
+	s.Rect(0, 0, size, size, "fill:#e8eef4")
+	mountains(s, landscapeOptions(v), layers, v.Int("complexity"), size, colors, seededRand(v))
+}
+
+func heightmapHandler(w http.ResponseWriter, req *http.Request, v Values) {
+	const size = 1000
+
+	field := diamondSquare(landscapeOptions(v), v.Int("complexity"), seededRand(v))
+
+	w.Header().Set("Content-Type", "image/svg+xml")
+	s := svg.New(w)
+	s.Start(size, size)
+	defer s.End()
+
+	if err := heightmap(s, field, v.Float("interval"), v.String("palette"), size); err != nil {
+		fmt.Println("Error rendering heightmap: ", err)
+	}
+}
+
+// Each ridgeline is a polygon through 2^complexity + 1 points and the bottom corners
+func ridgelineEstimate(v Values) Estimate {
+	return polygonEstimate(float64(v.Int("layers")), 1<<uint(v.Int("complexity"))+3)
+}
+
+// The heights typically span about heightmapRange times the roughness, and rougher
+// terrain has longer contours, each through about side^(2 - hurst) points
+func heightmapEstimate(v Values) Estimate {
+	const heightmapRange = 4.0
+
+	contours := math.Min(math.Ceil(heightmapRange*v.Float("roughness")/v.Float("interval")), maxContours)
+	side := float64(int(1)<<uint(v.Int("complexity")) + 1)
+	return contourEstimate(contours, math.Pow(side, 2.0-v.Float("hurst")))
+}
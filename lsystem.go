@@ -2,6 +2,8 @@ package main
 
 import (
 	"errors"
+	"math"
+	"sort"
 )
 
 const BUF_SIZE = 1024 * 1024
@@ -9,7 +11,8 @@ const BUF_SIZE = 1024 * 1024
 // Lindenmayer system
 type LSystem struct {
 	rules      map[byte][]byte
-	buf1       []byte
+	axiom      []byte
+	buf1       []byte // the buffers are only allocated once the system is iterated
 	buf2       []byte
 	len1, len2 int
 	cur        int
@@ -17,7 +20,7 @@ type LSystem struct {
 
 // create a New Lindenmayer system
 func NewLSystem() *LSystem {
-	return &LSystem{rules: make(map[byte][]byte), buf1: make([]byte, BUF_SIZE), buf2: make([]byte, BUF_SIZE), len1: 0, len2: 0, cur: 0}
+	return &LSystem{rules: make(map[byte][]byte), len1: 0, len2: 0, cur: 0}
 }
 
 // Setup the Lindenmayer object for computing a dragon fractal
@@ -26,11 +29,7 @@ func (sys *LSystem) InitDragon() {
 	sys.rules['X'] = []byte("X+YF")
 	sys.rules['Y'] = []byte("FX-Y")
 
-	sys.buf1[0] = 'F'
-	sys.buf1[1] = 'X'
-	sys.len1 = 2
-	sys.len2 = 0
-	sys.cur = 0
+	sys.setAxiom("FX")
 }
 
 // Setup the Lindenmayer object for computing a plant
@@ -39,15 +38,80 @@ func (sys *LSystem) InitPlant1() {
 	sys.rules['X'] = []byte("F-[[X]+X]+F[+FX]-X")
 	sys.rules['F'] = []byte("FF")
 
-	sys.buf1[0] = 'X'
-	sys.buf1[1] = 'F'
-	sys.len1 = 2
+	sys.setAxiom("XF")
+}
+
+// Internal helper, reset the system to the given axiom
+func (sys *LSystem) setAxiom(axiom string) {
+	sys.axiom = []byte(axiom)
+	sys.len1 = len(sys.axiom)
+	if sys.buf1 != nil {
+		copy(sys.buf1, sys.axiom)
+	}
 	sys.len2 = 0
 	sys.cur = 0
 }
 
+// Setup the Lindenmayer object for computing a Hilbert curve
+func (sys *LSystem) InitHilbert() {
+	sys.rules = make(map[byte][]byte)
+	sys.rules['A'] = []byte("+BF-AFA-FB+")
+	sys.rules['B'] = []byte("-AF+BFB+FA-")
+
+	sys.setAxiom("A")
+}
+
+// Setup the Lindenmayer object for computing a Moore curve
+func (sys *LSystem) InitMoore() {
+	sys.rules = make(map[byte][]byte)
+	sys.rules['L'] = []byte("-RF+LFL+FR-")
+	sys.rules['R'] = []byte("+LF-RFR-FL+")
+
+	sys.setAxiom("LFL+F+LFL")
+}
+
+// Setup the Lindenmayer object for computing a serpentine Peano curve
+func (sys *LSystem) InitPeano() {
+	sys.rules = make(map[byte][]byte)
+	sys.rules['X'] = []byte("XFYFX+F+YFXFY-F-XFYFX")
+	sys.rules['Y'] = []byte("YFXFY-F-XFYFX+F+YFXFY")
+
+	sys.setAxiom("X")
+}
+
+// Setup the Lindenmayer object for computing a Gosper curve (flowsnake),
+// both A and B are drawn as a forward step
+func (sys *LSystem) InitGosper() {
+	sys.rules = make(map[byte][]byte)
+	sys.rules['A'] = []byte("A-B--B+A++AA+B-")
+	sys.rules['B'] = []byte("+A-BB--B-A++A+B")
+
+	sys.setAxiom("A")
+}
+
+// Setup the Lindenmayer object for computing a Sierpinski curve
+func (sys *LSystem) InitSierpinski() {
+	sys.rules = make(map[byte][]byte)
+	sys.rules['X'] = []byte("XF-F+F-XF+F+XF-F+F-X")
+
+	sys.setAxiom("F+XF+F+XF")
+}
+
+// Setup the Lindenmayer object for computing a Sierpinski arrowhead curve,
+// both A and B are drawn as a forward step
+func (sys *LSystem) InitArrowhead() {
+	sys.rules = make(map[byte][]byte)
+	sys.rules['A'] = []byte("B-A-B")
+	sys.rules['B'] = []byte("A+B+A")
+
+	sys.setAxiom("A")
+}
+
 // Internal helper, get the current buffer
 func (sys *LSystem) getCurBuf() ([]byte, int) {
+	if sys.buf1 == nil {
+		return sys.axiom, sys.len1
+	}
 	if sys.cur == 0 {
 		return sys.buf1, sys.len1
 	}
@@ -99,6 +163,10 @@ func appendDestByte(dest []byte, curLength, maxLength int, value byte) (int, err
 
 // Iterate a L-System function through the specified number of iterations
 func (sys *LSystem) IterateSystem(iterations int) {
+	if iterations > 0 && sys.buf1 == nil {
+		sys.buf1, sys.buf2 = make([]byte, BUF_SIZE), make([]byte, BUF_SIZE)
+		copy(sys.buf1, sys.axiom)
+	}
 
 	for ; iterations > 0; iterations-- {
 		src, srcLen := sys.getCurBuf()
@@ -141,6 +209,317 @@ func (sys *LSystem) String() string {
 	return string(buf[:length])
 }
 
+// Return how many of each symbol the current output would hold after the given number
+// of iterations, without building it.  Each iteration multiplies the counts by the
+// matrix counting the symbols each rule replaces a symbol with.
+func (sys *LSystem) SymbolCounts(iterations int) map[byte]float64 {
+	matrix := make(map[byte]map[byte]float64)
+	for symbol, rule := range sys.rules {
+		row := make(map[byte]float64)
+		for _, c := range rule {
+			row[c]++
+		}
+		matrix[symbol] = row
+	}
+
+	counts := make(map[byte]float64)
+	buf, length := sys.getCurBuf()
+	for _, c := range buf[:length] {
+		counts[c]++
+	}
+	for ; iterations > 0; iterations-- {
+		next := make(map[byte]float64)
+		for symbol, n := range counts {
+			row, ok := matrix[symbol]
+			if !ok {
+				next[symbol] += n
+				continue
+			}
+			for c, m := range row {
+				next[c] += n * m
+			}
+		}
+		counts = next
+	}
+	return counts
+}
+
+// The net result of drawing a symbol expanded some number of times, in the frame where
+// the turtle starts at the origin heading along the x axis
+type lsystemEffect struct {
+	end     Point
+	heading Vector
+	hull    []Point // the convex hull of every point the turtle passes through
+	draws   bool
+	length  int // the number of symbols it expands to, at most BUF_SIZE
+}
+
+type lsystemKey struct {
+	symbol byte
+	depth  int
+}
+
+// An L-system drawn by a turtle.  Rather than building the whole string, each symbol is
+// expanded recursively, so symbols that would draw nothing on the canvas, or nothing
+// larger than the viewport's detail, need not be expanded.
+type LSystemCurve struct {
+	sys     *LSystem
+	axiom   []byte
+	draw    [256]bool
+	angle   float64
+	effects map[lsystemKey]*lsystemEffect
+}
+
+// Create a curve from an initialised L-system.  Symbols in draw move the turtle forward
+// one unit, '+' and '-' turn it by angle and '[' and ']' save and restore its state.
+func NewLSystemCurve(sys *LSystem, draw string, angle float64) *LSystemCurve {
+	c := &LSystemCurve{sys: sys, axiom: []byte(sys.String()), angle: angle, effects: make(map[lsystemKey]*lsystemEffect)}
+	for i := 0; i < len(draw); i++ {
+		c.draw[draw[i]] = true
+	}
+	return c
+}
+
+// Return the point p of a turtle's frame, for a turtle at location heading in direction
+func turtleFrame(location Point, direction Vector, p Point) Point {
+	return Point{X: location.X + p.X*direction.X - p.Y*direction.Y, Y: location.Y + p.X*direction.Y + p.Y*direction.X}
+}
+
+// Return the effect of a symbol expanded depth times
+func (c *LSystemCurve) effect(symbol byte, depth int) *lsystemEffect {
+	rule, ok := c.sys.rules[symbol]
+	if !ok {
+		depth = 0
+	}
+	key := lsystemKey{symbol: symbol, depth: depth}
+	if e, ok := c.effects[key]; ok {
+		return e
+	}
+
+	var e *lsystemEffect
+	if depth == 0 {
+		e = &lsystemEffect{heading: Vector{Point{X: 1.0}}, hull: []Point{{}}, length: 1}
+		switch {
+		case c.draw[symbol]:
+			e.end = Point{X: 1.0}
+			e.hull = append(e.hull, e.end)
+			e.draws = true
+		case symbol == '+':
+			sin, cos := math.Sincos(c.angle)
+			e.heading = Vector{Point{X: cos, Y: sin}}
+		case symbol == '-':
+			sin, cos := math.Sincos(-c.angle)
+			e.heading = Vector{Point{X: cos, Y: sin}}
+		}
+	} else {
+		e = c.sequenceEffect(rule, depth-1)
+	}
+	c.effects[key] = e
+	return e
+}
+
+// Return the effect of a string of symbols, each expanded depth times
+func (c *LSystemCurve) sequenceEffect(symbols []byte, depth int) *lsystemEffect {
+	var stack []turtleState
+	state := turtleState{direction: Vector{Point{X: 1.0}}}
+	points := []Point{{}}
+	e := &lsystemEffect{}
+	for _, symbol := range symbols {
+		e.length++
+		switch symbol {
+		case '[':
+			stack = append(stack, state)
+			continue
+		case ']':
+			if len(stack) > 0 {
+				state = stack[len(stack)-1]
+				stack = stack[:len(stack)-1]
+			}
+			continue
+		}
+		e.length--
+
+		sub := c.effect(symbol, depth)
+		for _, p := range sub.hull {
+			points = append(points, turtleFrame(state.location, state.direction, p))
+		}
+		state.location = turtleFrame(state.location, state.direction, sub.end)
+		state.direction = Vector{turtleFrame(Point{}, state.direction, sub.heading.Point)}
+		e.draws = e.draws || sub.draws
+		e.length = int(math.Min(float64(e.length+sub.length), BUF_SIZE))
+	}
+	e.end, e.heading = state.location, state.direction
+	e.hull = convexHull(points)
+	return e
+}
+
+// Return the bounding box of the curve expanded depth times
+func (c *LSystemCurve) Bounds(depth int) (low, high Point) {
+	hull := c.sequenceEffect(c.axiom, depth).hull
+	low, high = hull[0], hull[0]
+	for _, p := range hull {
+		low.X, low.Y = math.Min(low.X, p.X), math.Min(low.Y, p.Y)
+		high.X, high.Y = math.Max(high.X, p.X), math.Max(high.Y, p.Y)
+	}
+	return low, high
+}
+
+// Return the deepest expansion, up to complexity, whose string would fit the
+// L-system's buffer.  This bounds the number of steps drawn by an unzoomed curve.
+func (c *LSystemCurve) Depth(complexity int) int {
+	depth := 0
+	for depth < complexity && c.sequenceEffect(c.axiom, depth+1).length < BUF_SIZE {
+		depth++
+	}
+	return depth
+}
+
+// Return the number of steps drawn by the curve expanded depth times
+func (c *LSystemCurve) Segments(depth int) float64 {
+	segments := 0.0
+	for symbol, n := range c.sys.SymbolCounts(depth) {
+		if c.draw[symbol] {
+			segments += n
+		}
+	}
+	return segments
+}
+
+// Estimate drawing an L-system curve to the given complexity.  Zooming keeps about as
+// many steps on the canvas as the unzoomed curve draws.
+func lsystemEstimate(init func(sys *LSystem), draw string, complexity int) Estimate {
+	sys := NewLSystem()
+	init(sys)
+	c := NewLSystemCurve(sys, draw, 0.0)
+	return lineEstimate(c.Segments(c.Depth(complexity)))
+}
+
+// Return the depth to expand the curve to for the viewport.  This is deep enough that the
+// curve grows by the viewport's zoom, so zooming shows as much detail as the unzoomed
+// curve at base, but not so deep that a step is lost in the rounding of the curve's
+// coordinates.
+func (c *LSystemCurve) ZoomDepth(base int, vp *Viewport) int {
+	const maxExtent = 1 << 40
+
+	extent := func(depth int) float64 {
+		low, high := c.Bounds(depth)
+		return math.Max(high.X-low.X, high.Y-low.Y)
+	}
+	target := extent(base) * vp.Zoom
+	depth := base
+	for depth < base+maxZoomLevels && extent(depth) < target && extent(depth+1) <= maxExtent {
+		depth++
+	}
+	return depth
+}
+
+// Return the transform shrinking and turning the curve expanded from times so that it
+// runs between the same points as the curve expanded to times
+func (c *LSystemCurve) Similarity(from, to int) *Matrix {
+	a := c.sequenceEffect(c.axiom, from).end
+	b := c.sequenceEffect(c.axiom, to).end
+	d := a.X*a.X + a.Y*a.Y
+	if from == to || d == 0.0 {
+		return NewMatrix()
+	}
+	// the complex number b / a
+	re, im := (b.X*a.X+b.Y*a.Y)/d, (b.Y*a.X-b.X*a.Y)/d
+	return NewAffineMatrix(re, -im, im, re, 0.0, 0.0)
+}
+
+// Draw the curve expanded depth times with the turtle, whose transform places it on the
+// canvas.  A symbol is only expanded if some of its drawing is on the canvas and it is
+// larger than the viewport's detail.  Otherwise the turtle moves straight to where the
+// symbol leaves it, drawing a line there if it is on the canvas.  Drawing ends early if
+// the viewport's render is stopped.
+func (c *LSystemCurve) Render(t *Turtle, depth int, vp *Viewport) {
+	c.render(t, c.axiom, depth, vp)
+}
+
+func (c *LSystemCurve) render(t *Turtle, symbols []byte, depth int, vp *Viewport) {
+	for _, symbol := range symbols {
+		if vp.Stopped() {
+			return
+		}
+		switch symbol {
+		case '[':
+			t.PushState()
+			continue
+		case ']':
+			t.PopState()
+			continue
+		}
+
+		rule, ok := c.sys.rules[symbol]
+		if !ok || depth == 0 {
+			switch {
+			case c.draw[symbol]:
+				if low, high := t.CanvasBounds(c.effect(symbol, 0).hull); vp.Visible(low, high) {
+					t.Move(1.0)
+				} else {
+					t.Follow(Point{X: 1.0}, Vector{Point{X: 1.0}}, false)
+				}
+			case symbol == '+':
+				t.Turn(c.angle)
+			case symbol == '-':
+				t.Turn(-c.angle)
+			}
+			continue
+		}
+
+		e := c.effect(symbol, depth)
+		visible := false
+		if e.draws {
+			low, high := t.CanvasBounds(e.hull)
+			if vp.Visible(low, high) {
+				if math.Max(high.X-low.X, high.Y-low.Y) >= vp.Detail {
+					c.render(t, rule, depth-1, vp)
+					continue
+				}
+				low, high = t.CanvasBounds([]Point{{}, e.end})
+				visible = vp.Visible(low, high)
+			}
+		}
+		t.Follow(e.end, e.heading, visible)
+	}
+}
+
+// Return the convex hull of the points, anticlockwise from the lowest
+func convexHull(points []Point) []Point {
+	if len(points) < 3 {
+		return points
+	}
+	sorted := make([]Point, len(points))
+	copy(sorted, points)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].X != sorted[j].X {
+			return sorted[i].X < sorted[j].X
+		}
+		return sorted[i].Y < sorted[j].Y
+	})
+
+	turn := func(a, b, p Point) float64 {
+		return (b.X-a.X)*(p.Y-a.Y) - (b.Y-a.Y)*(p.X-a.X)
+	}
+	// the lower then upper chains of Andrew's monotone chain algorithm
+	hull := make([]Point, 0, len(sorted)+1)
+	for _, p := range sorted {
+		for len(hull) >= 2 && turn(hull[len(hull)-2], hull[len(hull)-1], p) <= 0.0 {
+			hull = hull[:len(hull)-1]
+		}
+		hull = append(hull, p)
+	}
+	lower := len(hull) + 1
+	for i := len(sorted) - 2; i >= 0; i-- {
+		p := sorted[i]
+		for len(hull) >= lower && turn(hull[len(hull)-2], hull[len(hull)-1], p) <= 0.0 {
+			hull = hull[:len(hull)-1]
+		}
+		hull = append(hull, p)
+	}
+	return hull[:len(hull)-1]
+}
+
 /*func main() {
 
 	const MAX_ITER = 12
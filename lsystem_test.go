@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http/httptest"
+	"runtime"
+	"testing"
+)
+
+func TestLSystemIterates(t *testing.T) {
+	sys := NewLSystem()
+	sys.InitDragon()
+	if sys.buf1 != nil || sys.String() != "FX" {
+		t.Fatalf("the dragon starts as %q", sys.String())
+	}
+	sys.IterateSystem(2)
+	if s := sys.String(); s != "FX+YF+FX-YF" {
+		t.Errorf("the dragon iterated twice is %q", s)
+	}
+	sys.InitDragon()
+	if s := sys.String(); s != "FX" {
+		t.Errorf("the dragon started again is %q", s)
+	}
+}
+
+// Return the bytes allocated by calling f
+func allocated(f func()) uint64 {
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	f()
+	runtime.ReadMemStats(&after)
+	return after.TotalAlloc - before.TotalAlloc
+}
+
+func TestRejectedLSystemAllocatesNoBuffers(t *testing.T) {
+	defer func(segments float64) { *maxSegments = segments }(*maxSegments)
+	*maxSegments = 10
+
+	for _, c := range []struct{ fractal, query string }{
+		{"dragon-curve", "complexity=12"},
+		{"plant1", ""},
+		{"hilbert-curve", "zoom=100"},
+	} {
+		f := findFractal(c.fractal)
+		url := f.Path + "?" + c.query
+		req := httptest.NewRequest("GET", url, nil)
+		w := httptest.NewRecorder()
+		if n := allocated(func() { f.ServeHTTP(w, req) }); n >= BUF_SIZE {
+			t.Errorf("%s allocated %d bytes", url, n)
+		}
+		if w.Code != 413 {
+			t.Errorf("%s gave %d rather than being refused", url, w.Code)
+		}
+
+		w = httptest.NewRecorder()
+		if n := allocated(func() { estimateHandler(w, httptest.NewRequest("GET", "/estimate?fractal="+f.Name+"&"+c.query, nil)) }); n >= BUF_SIZE {
+			t.Errorf("estimating %s allocated %d bytes", f.Name, n)
+		}
+	}
+}
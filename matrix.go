@@ -0,0 +1,173 @@
+package main
+
+import (
+	"errors"
+	"math"
+)
+
+// A 2d affine transform, held as a 3x3 matrix in homogeneous coordinates.
+//
+// The operations that modify a matrix (Translate, Scale, Shear, Rotate, ...)
+// multiply it on the right, so the last operation applied is the first one
+// to act on a point.  This matches the way the svg transform attribute works.
+type Matrix struct {
+	Rows [][]float64
+}
+
+// Create a new identity matrix
+func NewMatrix() *Matrix {
+	m := &Matrix{Rows: make([][]float64, 3)}
+	for i := range m.Rows {
+		m.Rows[i] = make([]float64, 3)
+	}
+	m.Identity()
+	return m
+}
+
+// Create an affine matrix, mapping (x, y) to (a*x + b*y + e, c*x + d*y + f)
+func NewAffineMatrix(a, b, c, d, e, f float64) *Matrix {
+	return &Matrix{Rows: [][]float64{{a, b, e}, {c, d, f}, {0.0, 0.0, 1.0}}}
+}
+
+// Create a matrix that maps the unit segment (0, 0) - (1, 0) onto the segment p1 - p2
+func NewSegmentMatrix(p1, p2 Point) *Matrix {
+	dx, dy := p2.X-p1.X, p2.Y-p1.Y
+	return NewAffineMatrix(dx, -dy, dy, dx, p1.X, p1.Y)
+}
+
+// Create a matrix that scales and centres the box low - high to fit
+// inside a size x size square, leaving margin around the edges
+func NewFitMatrix(low, high Point, size, margin float64) *Matrix {
+	extent := math.Max(high.X-low.X, high.Y-low.Y)
+	scale := 1.0
+	if extent > 0.0 {
+		scale = (size - 2.0*margin) / extent
+	}
+
+	m := NewMatrix()
+	m.Translate(size/2.0, size/2.0)
+	m.Scale(scale, scale)
+	m.Translate(-(low.X+high.X)/2.0, -(low.Y+high.Y)/2.0)
+	return m
+}
+
+// Return a copy of m
+func (m *Matrix) Copy() *Matrix {
+	dest := NewMatrix()
+	for i := range m.Rows {
+		copy(dest.Rows[i], m.Rows[i])
+	}
+	return dest
+}
+
+// Set a matrix to be an identity matrix
+func (m *Matrix) Identity() {
+	for i := range m.Rows {
+		for j := range m.Rows[i] {
+			if i == j {
+				m.Rows[i][j] = 1.0
+			} else {
+				m.Rows[i][j] = 0.0
+			}
+		}
+	}
+}
+
+// Set m to be m * other
+func (m *Matrix) Multiply(other *Matrix) {
+	product := MultMatrix(m, other)
+	m.Rows = product.Rows
+}
+
+// Move by (dx, dy)
+func (m *Matrix) Translate(dx, dy float64) {
+	m.Multiply(NewAffineMatrix(1.0, 0.0, 0.0, 1.0, dx, dy))
+}
+
+// Scale by sx along the x axis and sy along the y axis
+func (m *Matrix) Scale(sx, sy float64) {
+	m.Multiply(NewAffineMatrix(sx, 0.0, 0.0, sy, 0.0, 0.0))
+}
+
+// Shear x by kx * y and y by ky * x
+func (m *Matrix) Shear(kx, ky float64) {
+	m.Multiply(NewAffineMatrix(1.0, kx, ky, 1.0, 0.0, 0.0))
+}
+
+// rotate around the Z axis by theta radians
+func (m *Matrix) Rotate(theta float64) {
+	sinT, cosT := math.Sincos(theta)
+	m.Multiply(NewAffineMatrix(cosT, -sinT, sinT, cosT, 0.0, 0.0))
+}
+
+// rotate around the point p by theta radians
+func (m *Matrix) RotateAbout(theta float64, p Point) {
+	m.Translate(p.X, p.Y)
+	m.Rotate(theta)
+	m.Translate(-p.X, -p.Y)
+}
+
+// Return the determinant of the linear (non translation) part of m
+func (m *Matrix) Determinant() float64 {
+	return m.Rows[0][0]*m.Rows[1][1] - m.Rows[0][1]*m.Rows[1][0]
+}
+
+// Invert the matrix, returning an error if it has no inverse
+func (m *Matrix) Invert() error {
+	det := m.Determinant()
+	if det == 0.0 {
+		return errors.New("matrix is not invertible")
+	}
+	a, b, e := m.Rows[0][0], m.Rows[0][1], m.Rows[0][2]
+	c, d, f := m.Rows[1][0], m.Rows[1][1], m.Rows[1][2]
+	inv := NewAffineMatrix(d/det, -b/det, -c/det, a/det, (b*f-d*e)/det, (c*e-a*f)/det)
+	m.Rows = inv.Rows
+	return nil
+}
+
+// Apply the transform to a point
+func (m *Matrix) Apply(p Point) Point {
+	return MultMatrixPoint(m, p)
+}
+
+// Apply the transform to a vector, vectors are not affected by translation
+func (m *Matrix) ApplyVector(v Vector) Vector {
+	return *MultMatrixVector(m, &v)
+}
+
+// return the product of a * b
+func MultMatrix(a, b *Matrix) *Matrix {
+	dest := NewMatrix()
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			sum := 0.0
+			for k := 0; k < 3; k++ {
+				sum += a.Rows[i][k] * b.Rows[k][j]
+			}
+			dest.Rows[i][j] = sum
+		}
+	}
+	return dest
+}
+
+// Take the product of m * v and store the result in dest
+// This function is provided to reduce the amount of garbage
+// created
+func MultMatrixVectorWithDest(m *Matrix, v, dest *Vector) {
+	x := m.Rows[0][0]*v.X + m.Rows[0][1]*v.Y
+	y := m.Rows[1][0]*v.X + m.Rows[1][1]*v.Y
+	dest.X, dest.Y = x, y
+}
+
+// return the product of m * v
+func MultMatrixVector(m *Matrix, v *Vector) *Vector {
+	dest := &Vector{}
+	MultMatrixVectorWithDest(m, v, dest)
+	return dest
+}
+
+// return the product of m * p, unlike vectors points are moved by
+// the translation held in m
+func MultMatrixPoint(m *Matrix, p Point) Point {
+	return Point{X: m.Rows[0][0]*p.X + m.Rows[0][1]*p.Y + m.Rows[0][2], Y: m.Rows[1][0]*p.X + m.Rows[1][1]*p.Y + m.Rows[1][2]}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"errors"
+	"github.com/ajstarks/svgo"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"math/cmplx"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// A polynomial, with its coefficients ordered from the highest power down
+type Polynomial struct {
+	Coefficients []complex128
+}
+
+// The result of running Newton's method from each point of a grid
+type NewtonBasins struct {
+	Roots      []complex128
+	Basin      [][]int     // the index of the root reached, or -1
+	Iterations [][]float64 // the number of iterations taken to get there
+}
+
+// Create the polynomial with the given roots
+func NewPolynomialFromRoots(roots []complex128) *Polynomial {
+	coefficients := []complex128{1}
+	for _, r := range roots {
+		next := make([]complex128, len(coefficients)+1)
+		for i, c := range coefficients {
+			next[i] += c
+			next[i+1] -= c * r
+		}
+		coefficients = next
+	}
+	return &Polynomial{Coefficients: coefficients}
+}
+
+// The degree of the polynomial
+func (p *Polynomial) Degree() int {
+	return len(p.Coefficients) - 1
+}
+
+// Evaluate the polynomial and its derivative at z
+func (p *Polynomial) Evaluate(z complex128) (value, derivative complex128) {
+	for _, c := range p.Coefficients {
+		derivative = derivative*z + value
+		value = value*z + c
+	}
+	return value, derivative
+}
+
+// Find the roots of the polynomial with the Durand-Kerner method
+func (p *Polynomial) Roots() []complex128 {
+	const iterations = 500
+
+	n := p.Degree()
+	lead := p.Coefficients[0]
+	roots := make([]complex128, n)
+	for i := range roots {
+		roots[i] = cmplx.Pow(complex(0.4, 0.9), complex(float64(i), 0))
+	}
+	for k := 0; k < iterations; k++ {
+		for i := range roots {
+			value, _ := p.Evaluate(roots[i])
+			denominator := lead
+			for j := range roots {
+				if i != j {
+					denominator *= roots[i] - roots[j]
+				}
+			}
+			if denominator != 0 {
+				roots[i] -= value / denominator
+			}
+		}
+	}
+	return roots
+}
+
+// Run Newton's method from each point of the grid, recording which root it converges to
+func newtonBasins(p *Polynomial, roots []complex128, at func(x, y int) complex128, width, height, iterations int) *NewtonBasins {
+	const tolerance = 1e-6
+
+	basins := &NewtonBasins{Roots: roots, Basin: make([][]int, height), Iterations: make([][]float64, height)}
+	for y := 0; y < height; y++ {
+		basins.Basin[y] = make([]int, width)
+		basins.Iterations[y] = make([]float64, width)
+		for x := 0; x < width; x++ {
+			z := at(x, y)
+			basin, i := -1, 0
+			for ; i < iterations && basin < 0; i++ {
+				value, derivative := p.Evaluate(z)
+				if derivative == 0 {
+					break
+				}
+				z -= value / derivative
+				for k, r := range roots {
+					if cmplx.Abs(z-r) < tolerance {
+						basin = k
+						break
+					}
+				}
+			}
+			basins.Basin[y][x] = basin
+			basins.Iterations[y][x] = float64(i)
+		}
+	}
+	return basins
+}
+
+// Return a field that is 1 inside the basin of the given root and 0 elsewhere
+func (b *NewtonBasins) indicator(root int) [][]float64 {
+	field := make([][]float64, len(b.Basin))
+	for y, row := range b.Basin {
+		field[y] = make([]float64, len(row))
+		for x, basin := range row {
+			if basin == root {
+				field[y][x] = 1.0
+			}
+		}
+	}
+	return field
+}
+
+// Draw each basin as a filled region, then darken the slower converging points
+// with translucent bands
+func newtonFractal(s *svg.SVG, basins *NewtonBasins, colors []string, shade bool, grid, size, iterations int) {
+	view := NewMatrix()
+	view.Scale(float64(size)/float64(grid-1), float64(size)/float64(grid-1))
+
+	s.Rect(0, 0, size, size, "fill:black")
+	for i := range basins.Roots {
+		renderContourRegion(s, basins.indicator(i), 0.5, view, "stroke:none;fill:"+colors[i])
+	}
+	if shade {
+		for level := 2; level < iterations; level *= 2 {
+			renderContourRegion(s, basins.Iterations, float64(level), view, "stroke:none;fill:black;fill-opacity:0.15")
+		}
+	}
+}
+
+// Draw the basins as an image with one pixel per grid point
+func newtonImage(basins *NewtonBasins, colors []string, shade bool, iterations int) (image.Image, error) {
+	rgb := make([][3]float64, len(colors))
+	for i, c := range colors {
+		var err error
+		if rgb[i], err = parseColor(c); err != nil {
+			return nil, err
+		}
+	}
+
+	height := len(basins.Basin)
+	width := len(basins.Basin[0])
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			basin := basins.Basin[y][x]
+			if basin < 0 {
+				img.Set(x, y, color.Black)
+				continue
+			}
+			// match the svg, each doubling of the iterations darkens the colour by 15%
+			f := 1.0
+			if shade && basins.Iterations[y][x] > 2.0 {
+				f = math.Pow(0.85, math.Floor(math.Log2(basins.Iterations[y][x])))
+			}
+			c := rgb[basin]
+			img.Set(x, y, color.RGBA{R: uint8(c[0] * f), G: uint8(c[1] * f), B: uint8(c[2] * f), A: 255})
+		}
+	}
+	return img, nil
+}
+
+// Parse a space separated list of complex numbers, each either "re" or "re,im"
+func parseComplexList(value string) ([]complex128, error) {
+	var list []complex128
+	for _, item := range strings.Fields(value) {
+		parts := strings.Split(item, ",")
+		if len(parts) > 2 {
+			return nil, errors.New("invalid complex number " + item)
+		}
+		re, err := strconv.ParseFloat(parts[0], 64)
+		if err != nil {
+			return nil, err
+		}
+		im := 0.0
+		if len(parts) == 2 {
+			if im, err = strconv.ParseFloat(parts[1], 64); err != nil {
+				return nil, err
+			}
+		}
+		list = append(list, complex(re, im))
+	}
+	return list, nil
+}
+
+func newtonHandler(w http.ResponseWriter, req *http.Request, v Values) {
+	const (
+		maxDegree = 12
+
+		size = 1000
+	)
+
+	iterations := v.Int("iterations")
+	grid := v.Int("grid")
+
+	// the polynomial is given either by its roots or its coefficients
+	var p *Polynomial
+	var roots []complex128
+	if value := v.String("coefficients"); value != "" {
+		coefficients, err := parseComplexList(value)
+		if err != nil || len(coefficients) < 2 || coefficients[0] == 0 {
+			paramError(w, "coefficients", errors.New("need at least two coefficients, the first not zero"))
+			return
+		}
+		p = &Polynomial{Coefficients: coefficients}
+		if p.Degree() <= maxDegree {
+			roots = p.Roots()
+		}
+	} else {
+		var err error
+		if roots, err = parseComplexList(v.String("roots")); err != nil || len(roots) == 0 {
+			paramError(w, "roots", errors.New("need at least one root"))
+			return
+		}
+		p = NewPolynomialFromRoots(roots)
+	}
+	if p.Degree() > maxDegree {
+		paramError(w, "roots", errors.New("polynomial degree must be at most "+strconv.Itoa(maxDegree)))
+		return
+	}
+
+	colors, err := bandColors(v.String("palette"), len(roots))
+	if err != nil {
+		paramError(w, "palette", err)
+		return
+	}
+
+	shade := v.Bool("shade")
+
+	basins := newtonBasins(p, roots, complexGrid(complex(v.Float("cx"), v.Float("cy")), v.Float("zoom"), grid, grid), grid, grid, iterations)
+
+	if v.String("format") == "png" {
+		img, err := newtonImage(basins, colors, shade, iterations)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		_ = png.Encode(w, img)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/svg+xml")
+	s := svg.New(w)
+	s.Start(size, size)
+	defer s.End()
+
+	newtonFractal(s, basins, colors, shade, grid, size, iterations)
+}
+
+// A region is drawn for each root's basin, and for each level of shading
+func newtonEstimate(v Values) Estimate {
+	grid := v.Int("grid")
+	if v.String("format") == "png" {
+		return imageEstimate(grid, grid)
+	}
+
+	roots, _ := parseComplexList(v.String("roots"))
+	regions := len(roots)
+	if coefficients, err := parseComplexList(v.String("coefficients")); err == nil && len(coefficients) > 0 {
+		regions = len(coefficients) - 1
+	}
+	if v.Bool("shade") {
+		for level := 2; level < v.Int("iterations"); level *= 2 {
+			regions++
+		}
+	}
+	return contourEstimate(float64(regions), fieldContourPoints*float64(grid))
+}
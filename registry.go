@@ -0,0 +1,523 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The most read of a POSTed body
+const maxBodyBytes = 1 << 20
+
+// The kinds of value a fractal parameter may take
+const (
+	IntParam    = "int"
+	FloatParam  = "float"
+	BoolParam   = "bool"
+	ChoiceParam = "choice"
+	TextParam   = "text" // free form text, such as a list of points
+)
+
+// A parameter of a fractal, with its type, the range of values it accepts and the
+// value used when it is left out
+type Param struct {
+	Name        string      `json:"name"`
+	Type        string      `json:"type"`
+	Default     interface{} `json:"default"`
+	Range       []float64   `json:"range,omitempty"` // the smallest and largest numbers allowed
+	Choices     []string    `json:"choices,omitempty"`
+	Description string      `json:"description"`
+
+	validate func(value string) error // further checks on a text value
+}
+
+// A fractal the server can draw
+type Fractal struct {
+	Name        string  `json:"name"`
+	Title       string  `json:"title"`
+	Path        string  `json:"path"`
+	Group       string  `json:"group"` // the section of the index listing it
+	ContentType string  `json:"content_type"`
+	Params      []Param `json:"params"`
+
+	render   RenderFunc
+	estimate EstimateFunc
+}
+
+// Draw a fractal given the values of its parameters
+type RenderFunc func(w http.ResponseWriter, req *http.Request, v Values)
+
+// The values of a fractal's parameters, parsed from a request
+type Values struct {
+	fractal *Fractal
+	values  map[string]interface{}
+	tile    *MapTile    // the map tile being drawn, if any
+	stop    *RenderStop // stops the render early, if it is being drawn for a request
+	body    []byte      // the body POSTed with the request, if any
+}
+
+// A problem with one field of a request
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+func (v Values) Int(name string) int {
+	return v.values[name].(int)
+}
+
+func (v Values) Float(name string) float64 {
+	return v.values[name].(float64)
+}
+
+func (v Values) Bool(name string) bool {
+	return v.values[name].(bool)
+}
+
+func (v Values) String(name string) string {
+	return v.values[name].(string)
+}
+
+// Return a hash of the fractal and its parameter values, leaving out the named
+// parameters.  Values are hashed as parsed, so equal values written differently in a
+// url hash the same.
+func (v Values) Hash(omit ...string) string {
+	h := sha256.New()
+	fmt.Fprintln(h, v.fractal.Name)
+	for i := range v.fractal.Params {
+		name := v.fractal.Params[i].Name
+		skip := false
+		for _, o := range omit {
+			skip = skip || name == o
+		}
+		if !skip {
+			fmt.Fprintf(h, "%s=%v\n", name, v.values[name])
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Return the largest value a numeric parameter accepts
+func (v Values) Max(name string) float64 {
+	return v.fractal.Param(name).Range[1]
+}
+
+// Create an integer parameter taking values in [min, max]
+func NewIntParam(name string, defaultValue, min, max int, description string) Param {
+	return Param{Name: name, Type: IntParam, Default: defaultValue, Range: []float64{float64(min), float64(max)}, Description: description}
+}
+
+// Create a real parameter taking values in [min, max]
+func NewFloatParam(name string, defaultValue, min, max float64, description string) Param {
+	return Param{Name: name, Type: FloatParam, Default: defaultValue, Range: []float64{min, max}, Description: description}
+}
+
+// Create a boolean parameter
+func NewBoolParam(name string, defaultValue bool, description string) Param {
+	return Param{Name: name, Type: BoolParam, Default: defaultValue, Description: description}
+}
+
+// Create a parameter taking one of a list of values
+func NewChoiceParam(name, defaultValue string, choices []string, description string) Param {
+	return Param{Name: name, Type: ChoiceParam, Default: defaultValue, Choices: choices, Description: description}
+}
+
+// Create a free form text parameter
+func NewTextParam(name, defaultValue, description string) Param {
+	return Param{Name: name, Type: TextParam, Default: defaultValue, Description: description}
+}
+
+// Return a copy of the parameter that checks its text values with validate
+func (p Param) WithCheck(validate func(value string) error) Param {
+	p.validate = validate
+	return p
+}
+
+// Parse a value given in a url, an empty value giving the default
+func (p *Param) Parse(value string) (interface{}, error) {
+	if value == "" {
+		return p.Default, nil
+	}
+	switch p.Type {
+	case IntParam, FloatParam:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("must be a number")
+		}
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			return nil, fmt.Errorf("must be a finite number")
+		}
+		if p.Type == IntParam && f != math.Trunc(f) {
+			return nil, fmt.Errorf("must be an integer")
+		}
+		if len(p.Range) == 2 && (f < p.Range[0] || f > p.Range[1]) {
+			return nil, fmt.Errorf("must be in [%g, %g]", p.Range[0], p.Range[1])
+		}
+		if p.Type == IntParam {
+			return int(f), nil
+		}
+		return f, nil
+	case BoolParam:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("must be true or false")
+		}
+		return b, nil
+	case ChoiceParam:
+		for _, c := range p.Choices {
+			if value == c {
+				return value, nil
+			}
+		}
+		return nil, fmt.Errorf("must be one of %v", p.Choices)
+	default:
+		if p.validate != nil {
+			if err := p.validate(value); err != nil {
+				return nil, err
+			}
+		}
+		return value, nil
+	}
+}
+
+// Describe the parameter as it is given in a url
+func (p *Param) Usage() string {
+	switch p.Type {
+	case IntParam:
+		return fmt.Sprintf("%s=n (%s, an integer in [%d, %d], default %v)", p.Name, p.Description, int64(p.Range[0]), int64(p.Range[1]), p.Default)
+	case FloatParam:
+		return fmt.Sprintf("%s=n (%s, a real number in [%g, %g], default %.4g)", p.Name, p.Description, p.Range[0], p.Range[1], p.Default)
+	case BoolParam:
+		return fmt.Sprintf("%s=true|false (%s, default %v)", p.Name, p.Description, p.Default)
+	case ChoiceParam:
+		return fmt.Sprintf("%s=s (%s, one of %s, default %v)", p.Name, p.Description, strings.Join(p.Choices, ", "), p.Default)
+	}
+	if p.Default != "" {
+		return fmt.Sprintf("%s=s (%s, default %v)", p.Name, p.Description, p.Default)
+	}
+	return fmt.Sprintf("%s=s (%s)", p.Name, p.Description)
+}
+
+// Check a value decoded from JSON, returning it in the form it takes in a url
+func (p *Param) Check(value interface{}) (string, error) {
+	var s string
+	switch v := value.(type) {
+	case string:
+		s = v
+	case float64:
+		s = strconv.FormatFloat(v, 'g', -1, 64)
+	case bool:
+		s = strconv.FormatBool(v)
+	default:
+		// structured values, such as a flame definition, are passed on as JSON
+		b, err := json.Marshal(value)
+		if err != nil {
+			return "", err
+		}
+		s = string(b)
+	}
+	if _, err := p.Parse(s); err != nil {
+		return "", err
+	}
+	return s, nil
+}
+
+// Check a set of parameter values, returning them as a url query along with every
+// problem found
+func (f *Fractal) Check(values map[string]interface{}) (url.Values, []FieldError) {
+	query := url.Values{}
+	var problems []FieldError
+	known := make(map[string]bool)
+	for i := range f.Params {
+		p := &f.Params[i]
+		known[p.Name] = true
+		value, ok := values[p.Name]
+		if !ok || value == nil {
+			continue
+		}
+		s, err := p.Check(value)
+		if err != nil {
+			problems = append(problems, FieldError{Field: "params." + p.Name, Message: err.Error()})
+			continue
+		}
+		query.Set(p.Name, s)
+	}
+
+	var unknown []string
+	for name := range values {
+		if !known[name] {
+			unknown = append(unknown, name)
+		}
+	}
+	sort.Strings(unknown)
+	for _, name := range unknown {
+		problems = append(problems, FieldError{Field: "params." + name, Message: "unknown parameter"})
+	}
+	return query, problems
+}
+
+// Return the parameter with the given name, or nil
+func (f *Fractal) Param(name string) *Param {
+	for i := range f.Params {
+		if f.Params[i].Name == name {
+			return &f.Params[i]
+		}
+	}
+	return nil
+}
+
+// Parse the parameters given in a request's url, returning every problem found
+func (f *Fractal) Parse(req *http.Request) (Values, []FieldError) {
+	query := req.URL.Query()
+	v := Values{fractal: f, values: make(map[string]interface{})}
+	var problems []FieldError
+	for i := range f.Params {
+		p := &f.Params[i]
+		value, err := p.Parse(query.Get(p.Name))
+		if err != nil {
+			problems = append(problems, FieldError{Field: p.Name, Message: err.Error()})
+			continue
+		}
+		v.values[p.Name] = value
+	}
+	if req.Method == http.MethodPost && req.Body != nil {
+		// the body is read up front so the render can be estimated from it
+		body, err := io.ReadAll(io.LimitReader(req.Body, maxBodyBytes+1))
+		if err == nil && len(body) > maxBodyBytes {
+			err = fmt.Errorf("must be at most %d bytes", maxBodyBytes)
+		}
+		if err != nil {
+			problems = append(problems, FieldError{Field: "body", Message: err.Error()})
+		}
+		v.body = body
+	}
+	return v, problems
+}
+
+// Serve the fractal from the cache, or draw it, or list the problems with its
+// parameters
+func (f *Fractal) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	v, problems := f.Parse(req)
+	if len(problems) > 0 {
+		writeJSONErrors(w, http.StatusBadRequest, problems)
+		return
+	}
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		// a POSTed body, such as a flame, is not part of the cache key
+		_ = f.serve(w, req, v)
+		return
+	}
+	serveCached(w, req, v.Hash(), func(w http.ResponseWriter) error {
+		return f.serve(w, req, v)
+	})
+}
+
+// Draw the fractal once the server has room for it, or say why it won't be drawn.
+// Returns why the render stopped if it was cut short.
+func (f *Fractal) serve(w http.ResponseWriter, req *http.Request, v Values) error {
+	e := f.estimate(v)
+	if problems := checkBudget(e); problems != nil {
+		writeJSONErrors(w, http.StatusRequestEntityTooLarge, problems)
+		return nil
+	}
+	release := admit(w, req, e)
+	if release == nil {
+		return nil
+	}
+	defer release()
+	if format, _ := v.values["format"].(string); format == "svgz" {
+		z := newSVGZResponse(w, f.Name)
+		if err := f.draw(z, req, v); err != nil {
+			return err
+		}
+		return z.Close()
+	}
+	return f.draw(w, req, v)
+}
+
+// The form drawing a fractal, with an input for each of its parameters.  Numbers
+// with a narrow enough range get a slider as well, kept in step with the number.
+var formTemplate = template.Must(template.New("form").Parse(`<form class="fractal" action="{{.Path}}" method="get" data-title="{{.Title}}">
+{{- range .Params}}
+	<label title="{{.Description}}">{{.Label}}: </label>
+	{{- if .Options}}<select name="{{.Name}}">
+		{{- $default := printf "%v" .Default}}{{range .Options}}<option{{if eq . $default}} selected{{end}}>{{.}}</option>{{end -}}
+	</select>
+	{{- else if eq .Type "text"}}<input type="text" name="{{.Name}}" placeholder="{{.Default}}" />
+	{{- else}}
+		{{- if .Slider}}<input type="range" data-for="{{.Name}}" min="{{index .Range 0}}" max="{{index .Range 1}}" step="{{.Step}}" value="{{.Default}}" />{{end -}}
+		<input type="number" name="{{.Name}}" min="{{index .Range 0}}" max="{{index .Range 1}}" step="{{.Step}}" placeholder="{{.Default}}" />
+	{{- end}}
+{{- end}}
+	<input type="submit" value="Submit"/>
+</form>`))
+
+// The name of the parameter as it is shown on a form
+func (p Param) Label() string {
+	return strings.ToUpper(p.Name[:1]) + p.Name[1:]
+}
+
+// The values offered by a form's select, or nil if the parameter is typed in
+func (p Param) Options() []string {
+	if p.Type == BoolParam {
+		return []string{"false", "true"}
+	}
+	return p.Choices
+}
+
+// Whether a form should offer a slider for the parameter, which is only useful if
+// its range is narrow
+func (p Param) Slider() bool {
+	const (
+		maxIntRange   = 10000
+		maxFloatRange = 1000.0
+	)
+
+	switch p.Type {
+	case IntParam:
+		return p.Range[1]-p.Range[0] <= maxIntRange
+	case FloatParam:
+		return p.Range[1]-p.Range[0] <= maxFloatRange
+	}
+	return false
+}
+
+// The step of a form's number input
+func (p Param) Step() string {
+	if p.Type == IntParam {
+		return "1"
+	}
+	return "any"
+}
+
+// Return the html form drawing the named fractal
+func fractalForm(name string) (template.HTML, error) {
+	f := findFractal(name)
+	if f == nil {
+		return "", fmt.Errorf("no fractal named %s", name)
+	}
+	var b bytes.Buffer
+	if err := formTemplate.Execute(&b, f); err != nil {
+		return "", err
+	}
+	return template.HTML(b.String()), nil
+}
+
+// A section of the index page
+type FractalGroup struct {
+	Title    string
+	Fractals []*Fractal
+}
+
+// Return the fractals by group, in the order the groups are first listed
+func fractalGroups() []*FractalGroup {
+	var groups []*FractalGroup
+	byTitle := make(map[string]*FractalGroup)
+	for _, f := range fractals {
+		g, ok := byTitle[f.Group]
+		if !ok {
+			g = &FractalGroup{Title: f.Group}
+			byTitle[f.Group] = g
+			groups = append(groups, g)
+		}
+		g.Fractals = append(g.Fractals, f)
+	}
+	return groups
+}
+
+// Return the fractal with the given name, or nil
+func findFractal(name string) *Fractal {
+	for _, f := range fractals {
+		if f.Name == name {
+			return f
+		}
+	}
+	return nil
+}
+
+// Write v as a JSON response
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(v); err != nil {
+		fmt.Println("Error writing JSON: ", err)
+	}
+}
+
+// Write a JSON error response listing the problems
+func writeJSONErrors(w http.ResponseWriter, status int, problems []FieldError) {
+	writeJSON(w, status, map[string][]FieldError{"errors": problems})
+}
+
+// Reject a request because of a problem with one parameter
+func paramError(w http.ResponseWriter, name string, err error) {
+	writeJSONErrors(w, http.StatusBadRequest, []FieldError{{Field: name, Message: err.Error()}})
+}
+
+// Print the url parameters each fractal takes
+func printUsage(w io.Writer) {
+	for _, f := range fractals {
+		fmt.Fprintf(w, "\n%s (%s):\n", f.Title, f.Path)
+		for i := range f.Params {
+			fmt.Fprintln(w, f.Params[i].Usage())
+		}
+	}
+}
+
+// List every fractal and its parameters
+func apiFractalsHandler(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, http.StatusOK, fractals)
+}
+
+// Render a fractal described by a JSON body of the form
+// {"fractal": "name", "params": {"name": value, ...}}
+func apiRenderHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeJSONErrors(w, http.StatusMethodNotAllowed, []FieldError{{Message: "use POST"}})
+		return
+	}
+
+	var body struct {
+		Fractal string                 `json:"fractal"`
+		Params  map[string]interface{} `json:"params"`
+	}
+	decoder := json.NewDecoder(http.MaxBytesReader(w, req.Body, maxBodyBytes))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&body); err != nil {
+		writeJSONErrors(w, http.StatusBadRequest, []FieldError{{Message: "invalid JSON: " + err.Error()}})
+		return
+	}
+
+	f := findFractal(body.Fractal)
+	if f == nil {
+		writeJSONErrors(w, http.StatusBadRequest, []FieldError{{Field: "fractal", Message: "unknown fractal " + strconv.Quote(body.Fractal)}})
+		return
+	}
+	query, problems := f.Check(body.Params)
+	if len(problems) > 0 {
+		writeJSONErrors(w, http.StatusBadRequest, problems)
+		return
+	}
+
+	// hand the checked parameters to the fractal's own handler as a url query
+	r, err := http.NewRequestWithContext(req.Context(), http.MethodGet, f.Path+"?"+query.Encode(), nil)
+	if err != nil {
+		writeJSONErrors(w, http.StatusInternalServerError, []FieldError{{Message: err.Error()}})
+		return
+	}
+	r.RemoteAddr = req.RemoteAddr
+	f.ServeHTTP(w, r)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"github.com/ajstarks/svgo"
+	"math"
+	"net/http"
+)
+
+// A space filling curve produced by a Lindenmayer system
+type SpaceFillingCurve struct {
+	Init              func(sys *LSystem)
+	Angle             float64 // in radians
+	Draw              string  // the symbols that move the turtle forward
+	DefaultComplexity int
+	MaxComplexity     int
+}
+
+var (
+	hilbertCurve    = &SpaceFillingCurve{Init: (*LSystem).InitHilbert, Angle: math.Pi / 2.0, Draw: "F", DefaultComplexity: 5, MaxComplexity: 9}
+	mooreCurve      = &SpaceFillingCurve{Init: (*LSystem).InitMoore, Angle: math.Pi / 2.0, Draw: "F", DefaultComplexity: 4, MaxComplexity: 8}
+	peanoSerpentine = &SpaceFillingCurve{Init: (*LSystem).InitPeano, Angle: math.Pi / 2.0, Draw: "F", DefaultComplexity: 3, MaxComplexity: 5}
+	gosperCurve     = &SpaceFillingCurve{Init: (*LSystem).InitGosper, Angle: math.Pi / 3.0, Draw: "AB", DefaultComplexity: 3, MaxComplexity: 5}
+	sierpinskiCurve = &SpaceFillingCurve{Init: (*LSystem).InitSierpinski, Angle: math.Pi / 2.0, Draw: "F", DefaultComplexity: 4, MaxComplexity: 7}
+)
+
+// Draw the curve, scaled and centred so that it fills a size x size square, then
+// magnified by the viewport
+func spaceFillingCurve(s *svg.SVG, curve *SpaceFillingCurve, vp *Viewport, complexity, size, margin int) {
+	sys := NewLSystem()
+	curve.Init(sys)
+	c := NewLSystemCurve(sys, curve.Draw, curve.Angle)
+	depth := c.ZoomDepth(c.Depth(complexity), vp)
+
+	low, high := c.Bounds(depth)
+	view := NewFitMatrix(low, high, float64(size), float64(margin))
+
+	t := NewTurtle(s)
+	t.SetTransform(MultMatrix(vp.Matrix(), view))
+	c.Render(t, depth, vp)
+}
+
+// Create a handler drawing the given curve
+func spaceFillingHandler(curve *SpaceFillingCurve) RenderFunc {
+	return func(w http.ResponseWriter, req *http.Request, v Values) {
+		const (
+			size   = 1000
+			margin = 20
+		)
+
+		complexity := v.Int("complexity")
+
+		w.Header().Set("Content-Type", "image/svg+xml")
+		s := svg.New(w)
+		s.Start(size, size)
+		defer s.End()
+
+		spaceFillingCurve(s, curve, NewViewport(v, size, size), complexity, size, margin)
+	}
+}
+
+// Create the estimate for drawing the given curve
+func spaceFillingEstimate(curve *SpaceFillingCurve) EstimateFunc {
+	return func(v Values) Estimate {
+		return lsystemEstimate(curve.Init, curve.Draw, v.Int("complexity"))
+	}
+}
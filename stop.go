@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Looking at a context is slow next to drawing a segment, so a render only looks every
+// this many steps
+const stopCheckInterval = 1024
+
+// Stops a render once its request is cancelled or runs out of time.  Once stopped it
+// stays stopped, so a recursion unwinds without drawing anything more.
+type RenderStop struct {
+	ctx   context.Context
+	steps int
+	err   error
+}
+
+// Count a step of the render, returning whether it should stop.  A nil RenderStop
+// never stops.
+func (r *RenderStop) Stopped() bool {
+	if r == nil {
+		return false
+	}
+	if r.err == nil {
+		r.steps++
+		if r.steps%stopCheckInterval == 0 {
+			r.err = r.ctx.Err()
+		}
+	}
+	return r.err != nil
+}
+
+// Return why the render stopped, or nil if it has not
+func (r *RenderStop) Err() error {
+	if r == nil {
+		return nil
+	}
+	return r.err
+}
+
+// Describe why a render stopped
+func stopReason(err error) string {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Sprintf("it took longer than the %v allowed", *renderTimeout)
+	}
+	return "the client went away"
+}
+
+// Draw the fractal, stopping if the request is cancelled or takes longer than the
+// -timeout flag allows.  Returns why the render stopped, which is also logged, or nil
+// if it finished.
+func (f *Fractal) draw(w http.ResponseWriter, req *http.Request, v Values) error {
+	ctx := req.Context()
+	if *renderTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *renderTimeout)
+		defer cancel()
+		req = req.WithContext(ctx)
+	}
+
+	start := time.Now()
+	v.stop = &RenderStop{ctx: ctx}
+	f.render(w, req, v)
+	err := v.stop.Err()
+	if err != nil {
+		fmt.Println("Stopped drawing", req.URL, "after", time.Since(start).Round(time.Millisecond), "as", stopReason(err))
+	}
+	return err
+}
@@ -14,13 +14,29 @@ import (
 	"html/template"
 	"io"
 	"math"
+	"math/rand"
 	"net/http"
 	"os"
-	"strconv"
+	"path/filepath"
+	"runtime"
+	"time"
 )
 
 var (
-	addr = flag.String("addr", "localhost:8080", "Port to listen on")
+	addr          = flag.String("addr", "localhost:8080", "Port to listen on")
+	tileDir       = flag.String("tiles", "", "Directory also keeping drawn map tiles, empty to not keep them on disk")
+	maxSegments   = flag.Float64("segments", 1<<21, "Refuse to draw anything estimated to take more segments than this")
+	maxBytes      = flag.Float64("bytes", 1<<28, "Refuse to draw anything estimated to take more bytes than this")
+	renderTimeout = flag.Duration("timeout", time.Minute, "Longest a curve may take to draw, 0 for no limit")
+
+	maxRenders       = flag.Int("renders", runtime.NumCPU(), "Most pictures drawn at once")
+	maxClientRenders = flag.Int("client-renders", 4, "Most pictures drawn or waiting at once for one client address")
+	maxQueue         = flag.Int("queue", 64, "Most pictures waiting to be drawn")
+	maxWait          = flag.Duration("wait", 10*time.Second, "Longest a picture may wait to be drawn")
+	maxMemory        = flag.Float64("memory", 1<<30, "Most estimated bytes of pictures drawn at once")
+
+	cacheSize = flag.Int64("cache", 64<<20, "Bytes of drawn pictures kept in memory")
+	cacheDir  = flag.String("cache-dir", "", "Directory also keeping drawn pictures, empty to not keep them on disk")
 )
 
 // A point in 2d space
@@ -33,19 +49,44 @@ type Vector struct {
 	Point
 }
 
-type Matrix struct {
-	Rows [][]float64
-}
-
 type CachedTemplate struct {
 	t    *template.Template
 	mod  int64
 	path string
 }
 
+// The shape of the spike added to each segment of a koch curve.
+// Position, Width and Apex are fractions of the segment being replaced,
+// Height is a fraction of the segment length.
+type KochOptions struct {
+	Position    float64
+	Width       float64
+	Height      float64
+	Apex        float64
+	Orientation string
+	Random      bool
+	Jitter      float64
+
+	rot, mirror *Matrix
+	view        *Matrix
+	viewport    *Viewport
+	flipped     []bool  // by level
+	bound       float64 // the curve on a segment lies within this many lengths of its middle
+	depth       int
+	seed        int64
+}
+
 type PeanoOptions struct {
 	Height        float64
 	DisplayCenter bool
+	Random        bool
+	Jitter        float64
+
+	view     *Matrix
+	viewport *Viewport
+	bound    float64
+	depth    int
+	seed     int64
 }
 
 var (
@@ -57,13 +98,18 @@ func NewTemplate(path string) *CachedTemplate {
 	if err != nil {
 		panic("Error loading template file " + path + " " + err.Error())
 	}
-	return &CachedTemplate{t: template.Must(template.ParseFiles(path)), mod: fInfo.ModTime().Unix(), path: path}
+	return &CachedTemplate{t: template.Must(parseTemplate(path)), mod: fInfo.ModTime().Unix(), path: path}
+}
+
+// Parse a template file, with the functions the templates may call
+func parseTemplate(path string) (*template.Template, error) {
+	return template.New(filepath.Base(path)).Funcs(template.FuncMap{"form": fractalForm}).ParseFiles(path)
 }
 
 func (t *CachedTemplate) Execute(w io.Writer, d interface{}) error {
 	fInfo, err := os.Stat(t.path)
 	if err == nil && fInfo.ModTime().Unix() > t.mod {
-		newT, err := template.ParseFiles(t.path)
+		newT, err := parseTemplate(t.path)
 		if err == nil {
 			t.t = newT
 			t.mod = fInfo.ModTime().Unix()
@@ -72,39 +118,6 @@ func (t *CachedTemplate) Execute(w io.Writer, d interface{}) error {
 	return t.t.Execute(w, d)
 }
 
-func NewMatrix() *Matrix {
-	m := &Matrix{Rows: make([][]float64, 2)}
-	for i := range m.Rows {
-		m.Rows[i] = make([]float64, 2)
-	}
-	m.Identity()
-	//m := Matrix{Rows: {{1.0, 0.0}, {0.0, 1.0}}}
-
-	return m
-}
-
-// Set a matrix to be an identity matrix
-func (m *Matrix) Identity() {
-	for i := range m.Rows {
-		for j := range m.Rows[i] {
-			if i == j {
-				m.Rows[i][j] = 1.0
-			} else {
-				m.Rows[i][j] = 0.0
-			}
-		}
-	}
-}
-
-// rotate around the Z azis by theta degrees
-func (m *Matrix) Rotate(theta float64) {
-	sinT, cosT := math.Sincos(theta)
-	m.Rows[0][0] = cosT
-	m.Rows[0][1] = -sinT
-	m.Rows[1][0] = sinT
-	m.Rows[1][1] = cosT
-}
-
 // A 2d line composed of a point, direction
 // and a scale (used to view the line as a segment)
 type Line struct {
@@ -114,7 +127,7 @@ type Line struct {
 }
 
 func (p Point) GoString() string {
-	return fmt.Sprintf("p(%s, %s)", p.X, p.Y)
+	return fmt.Sprintf("p(%g, %g)", p.X, p.Y)
 }
 
 func (p Point) Render(s *svg.SVG) {
@@ -122,7 +135,7 @@ func (p Point) Render(s *svg.SVG) {
 }
 
 func (v Vector) GoString() string {
-	return fmt.Sprintf("v(%s, %s)", v.X, v.Y)
+	return fmt.Sprintf("v(%g, %g)", v.X, v.Y)
 }
 
 func (v *Vector) Reverse() {
@@ -182,14 +195,24 @@ func (l Line) At(t float64) Point {
 }
 
 func (l Line) GoString() string {
-	return fmt.Sprintf("L: %s - %s %s", l.Start, l.Direction, l.Scale)
+	return fmt.Sprintf("L: %#v - %#v %g", l.Start, l.Direction, l.Scale)
+}
+
+// Return the line moved by the transform m
+func (l Line) Transform(m *Matrix) Line {
+	return Line{Start: m.Apply(l.Start), Direction: m.ApplyVector(l.Direction), Scale: l.Scale}
 }
 
 // draw a line
 func (l Line) Render(s *svg.SVG) {
+	l.RenderStyle(s, "fill:none;stroke:black")
+}
+
+// draw a line with the given svg style
+func (l Line) RenderStyle(s *svg.SVG, style string) {
 	if l.Scale != 0.0 {
 		end := l.At(1.0)
-		s.Line(int(l.Start.X), int(l.Start.Y), int(end.X), int(end.Y), "fill:none;stroke:black")
+		s.Line(int(l.Start.X), int(l.Start.Y), int(end.X), int(end.Y), style)
 	}
 }
 
@@ -231,127 +254,174 @@ func cross(v Vector) *Vector {
 	return &Vector{Point{X: y1*z2 - z1*y2, Y: z1*x1 - x1*z2}}
 }
 
-// Take the product of m * v and store the result in dest
-// This function is provided to reduce the amount of garbage
-// created
-func MultMatrixVectorWithDest(m *Matrix, v, dest *Vector) {
-	dest.X = m.Rows[0][0]*v.X + m.Rows[0][1]*v.Y
-	dest.Y = m.Rows[1][0]*v.X + m.Rows[1][1]*v.Y
-}
-
-// return the product of m * v
-func MultMatrixVector(m *Matrix, v *Vector) *Vector {
-	dest := &Vector{}
-	MultMatrixVectorWithDest(m, v, dest)
-	return dest
-}
-
-// Do the fractal
-func doKochCurve(s *svg.SVG, l Line, depth int, rot *Matrix) {
-	if depth <= 0 {
-		l.Render(s)
-	} else {
-		//cdir := cross(l.Direction)
-		cdir := MultMatrixVector(rot, &l.Direction)
-		mid := l.At(0.5)
-		l1, l2 := l.Split(0.333333)
-		_, l3 := l2.Split(0.5)
+// Return the four segments replacing l, with a spike of the given height that is on
+// the other side of the segment if flipped
+func kochChildren(l Line, options *KochOptions, height float64, flipped bool) []Line {
+	rot := options.rot
+	if flipped {
+		rot = options.mirror
+	}
+	cdir := MultMatrixVector(rot, &l.Direction)
 
-		//fmt.Printf("---\n\tl1: %v\n\tl2: %v\n---\n", l1, l3)
-		//fmt.Println(cdir)
-		//l1.Render(s)
-		doKochCurve(s, l1, depth-1, rot)
-		//mid.Render(s)
+	baseStart := options.Position - options.Width/2.0
+	baseEnd := options.Position + options.Width/2.0
 
-		lmid := NewLine2(mid, *cdir, l1.Scale*1.0)
-		//lmid.Render(s)
+	l1 := NewLine3(l.Start, l.At(baseStart))
+	l3 := NewLine3(l.At(baseEnd), l.At(1.0))
 
-		mid2 := lmid.At(1.0)
+	apex := l.At(baseStart + options.Width*options.Apex)
+	lmid := NewLine2(apex, *cdir, l.Scale*height)
+	mid2 := lmid.At(1.0)
 
-		l2a := NewLine3(l1.At(1.0), mid2)
-		//l2a.Render(s)
+	l2a := NewLine3(l1.At(1.0), mid2)
+	l2b := NewLine3(mid2, l3.At(0.0))
 
-		l2b := NewLine3(mid2, l3.At(0.0))
-		//l2b.Render(s)
+	return []Line{l1, l2a, l2b, l3}
+}
 
-		doKochCurve(s, l2a, depth-1, rot)
-		doKochCurve(s, l2b, depth-1, rot)
+// Do the fractal, skipping segments that are off the canvas and stopping at segments
+// too small to show more detail, or at every segment once the render is stopped
+func doKochCurve(s *svg.SVG, l Line, level int, node uint64, options *KochOptions) {
+	if options.viewport.Stopped() {
+		return
+	}
+	screen := l.Transform(options.view)
+	length := math.Abs(screen.Length())
+	if !options.viewport.VisibleDisk(screen.At(0.5), options.bound*length) {
+		return
+	}
+	if level >= options.depth || length < options.viewport.Detail {
+		if options.viewport.VisibleLine(screen) {
+			screen.Render(s)
+		}
+		return
+	}
 
-		//l3.Render(s)
-		doKochCurve(s, l3, depth-1, rot)
+	flipped := options.flipped[level]
+	spikeHeight := options.Height
+	if options.Random {
+		flipped = nodeRandom(options.seed, node, 0) < 0.5
+		spikeHeight *= 1.0 + options.Jitter*(2.0*nodeRandom(options.seed, node, 1)-1.0)
+	}
+	for i, child := range kochChildren(l, options, spikeHeight, flipped) {
+		doKochCurve(s, child, level+1, childNode(node, i), options)
 	}
 }
 
-func kochCurve(s *svg.SVG, x1, y1, x2, y2, complexity int, rotation float64) {
-	l := NewLine(float64(x1), float64(y1), float64(x2), float64(y2))
+// Draw a koch curve along the unit segment (0, 0) - (1, 0), placed on the canvas by view
+// and magnified by the viewport.  node identifies the curve, so that the random spikes
+// of different curves differ.
+func kochCurve(s *svg.SVG, view *Matrix, vp *Viewport, complexity int, rotation float64, options *KochOptions, node uint64) {
+	l := NewLine(0.0, 0.0, 1.0, 0.0)
+
+	options.view = MultMatrix(vp.Matrix(), view)
+	options.viewport = vp
+	options.rot = NewMatrix()
+	options.rot.Rotate(rotation)
+	options.mirror = NewMatrix()
+	options.mirror.Rotate(-rotation)
+
+	// the tallest spike the random heights allow bounds the curve, but the spikes
+	// shrink on average like the unperturbed ones
+	maxHeight := options.Height
+	if options.Random {
+		maxHeight *= 1.0 + options.Jitter
+	}
+	options.bound, _ = subdivisionBound(l, kochChildren(l, options, maxHeight, false))
+	_, ratio := subdivisionBound(l, kochChildren(l, options, options.Height, false))
+	options.depth = complexity + vp.Levels(1.0/ratio)
+
+	// work out which levels have their spike on the other side of the segment
+	options.flipped = make([]bool, options.depth)
+	for level := range options.flipped {
+		switch options.Orientation {
+		case "alternate":
+			options.flipped[level] = level%2 == 1
+		case "random":
+			options.flipped[level] = nodeRandom(options.seed, uint64(level), 2) < 0.5
+		}
+	}
 
-	//fmt.Printf("kochCurve (%d, %d) - (%d, %d)\n", x1, y1, x2, y2)
-	//fmt.Printf("line: %s\n\n", l)
+	doKochCurve(s, l, 0, node, options)
+}
 
-	m := NewMatrix()
-	m.Rotate(rotation)
+// Return the transform placing the unit segment between two points on the canvas
+func canvasSegment(x1, y1, x2, y2 int) *Matrix {
+	return NewSegmentMatrix(Point{X: float64(x1), Y: float64(y1)}, Point{X: float64(x2), Y: float64(y2)})
+}
 
-	doKochCurve(s, l, complexity, m)
+// Return the random source used by the randomised curves, seeded so the same url
+// gives the same curve
+func seededRand(v Values) *rand.Rand {
+	return rand.New(rand.NewSource(int64(v.Int("seed"))))
 }
 
-func kochCurveHandler(w http.ResponseWriter, req *http.Request) {
-	const (
-		defaultComplexity = 6
-		maxComplexity     = 9
+// Return the spike shape options shared by the koch curve and snowflake
+func kochOptions(v Values) *KochOptions {
+	options := &KochOptions{
+		Width:       v.Float("width"),
+		Height:      v.Float("height"),
+		Apex:        v.Float("apex"),
+		Orientation: v.String("orient"),
+		Random:      v.Bool("random"),
+		Jitter:      v.Float("jitter"),
+		seed:        int64(v.Int("seed")),
+	}
 
-		defaultPi = 0.5
-		maxPi     = 1.0
-		minPi     = -1.0
-	)
+	// keep the base of the spike within the segment
+	options.Position = math.Min(math.Max(v.Float("position"), options.Width/2.0), 1.0-options.Width/2.0)
 
-	_ = req.ParseForm()
-	complexity, err := strconv.Atoi(req.FormValue("complexity"))
-	if err != nil || complexity < 0 || complexity > maxComplexity {
-		complexity = defaultComplexity
-	}
+	return options
+}
 
-	pi, err := strconv.ParseFloat(req.FormValue("pi"), 64)
-	if err != nil {
-		pi = defaultPi
-	}
-	if pi < minPi {
-		pi = minPi
-	} else if pi > maxPi {
-		pi = maxPi
-	}
+func kochCurveHandler(w http.ResponseWriter, req *http.Request, v Values) {
+	complexity := v.Int("complexity")
+	maxComplexity := int(v.Max("complexity"))
+	pi := v.Float("pi")
 	if pi == 0.0 || pi == 1.0 {
 		complexity = 0
 	}
 
+	options := kochOptions(v)
+
 	w.Header().Set("Content-Type", "image/svg+xml")
 	s := svg.New(w)
 	width := 1000 + (4000 * complexity / maxComplexity)
 	height := int(float64(width)*0.35) + 50
+	vp := NewViewport(v, width, height)
 	s.Start(width, height)
 	defer s.End()
 	if pi < 0.0 {
-		kochCurve(s, 0, 50, width-1, 50, complexity, -math.Pi*pi)
+		kochCurve(s, canvasSegment(0, 50, width-1, 50), vp, complexity, -math.Pi*pi, options, 0)
 	} else {
-		kochCurve(s, 0, height-50, width-1, height-50, complexity, -math.Pi*pi)
+		kochCurve(s, canvasSegment(0, height-50, width-1, height-50), vp, complexity, -math.Pi*pi, options, 0)
 	}
 }
 
-func kochSnowflakeHandler(w http.ResponseWriter, req *http.Request) {
-	const (
-		defaultComplexity = 5
-		maxComplexity     = 8
-	)
-
-	_ = req.ParseForm()
-	complexity, err := strconv.Atoi(req.FormValue("complexity"))
-	if err != nil || complexity < 0 || complexity > maxComplexity {
-		complexity = defaultComplexity
+// Each level replaces a segment with four
+func kochCurveEstimate(v Values) Estimate {
+	complexity := v.Int("complexity")
+	if pi := v.Float("pi"); pi == 0.0 || pi == 1.0 {
+		complexity = 0
 	}
+	return lineEstimate(powerOf(4, complexity))
+}
+
+func kochSnowflakeEstimate(v Values) Estimate {
+	return lineEstimate(3.0 * powerOf(4, v.Int("complexity")))
+}
+
+func kochSnowflakeHandler(w http.ResponseWriter, req *http.Request, v Values) {
+	complexity := v.Int("complexity")
+	maxComplexity := int(v.Max("complexity"))
+
+	options := kochOptions(v)
 
 	w.Header().Set("Content-Type", "image/svg+xml")
 	s := svg.New(w)
 	width := 1000 + (4000 * complexity / maxComplexity)
 	height := width
+	vp := NewViewport(v, width, height)
 
 	offset := width / 4
 	pi := .5
@@ -359,97 +429,105 @@ func kochSnowflakeHandler(w http.ResponseWriter, req *http.Request) {
 
 	s.Start(width, height)
 	defer s.End()
-	kochCurve(s, offset, offset, width-offset, offset, complexity, rotation)
-	kochCurve(s, width-offset, offset, width/2, height-offset, complexity, rotation)
-	kochCurve(s, width/2, height-offset, offset, offset, complexity, rotation)
+	kochCurve(s, canvasSegment(offset, offset, width-offset, offset), vp, complexity, rotation, options, 0)
+	kochCurve(s, canvasSegment(width-offset, offset, width/2, height-offset), vp, complexity, rotation, options, 1)
+	kochCurve(s, canvasSegment(width/2, height-offset, offset, offset), vp, complexity, rotation, options, 2)
 }
 
-// Do the fractal
-func doPeanoCurve(s *svg.SVG, l Line, options *PeanoOptions, depth int) {
-	if depth <= 0 {
-		l.Render(s)
-	} else {
-		height := options.Height
-
-		length := l.Length()
-
-		perpendicular := cross(l.Direction)
-
-		//fmt.Printf("segment len %f perp %s\n", length, perpendicular)
-
-		intersect1 := l.At(1.0 / 3.0)
-		intersect2 := l.At(2.0 / 3.0)
+// Return the segments replacing l, with the middle segments raised by height and
+// lowered by lowerHeight
+func peanoChildren(l Line, options *PeanoOptions, height, lowerHeight float64) []Line {
+	length := l.Length()
 
-		l1 := NewLine2(intersect1, *perpendicular, 1.0)
-		l1.SetLength(length * height)
+	perpendicular := cross(l.Direction)
 
-		l2 := NewLine2(intersect2, *perpendicular, 1.0)
-		l2.SetLength(length * height)
+	intersect1 := l.At(1.0 / 3.0)
+	intersect2 := l.At(2.0 / 3.0)
 
-		l3 := NewLine3(l1.At(1.0), l2.At(1.0))
+	l1 := NewLine2(intersect1, *perpendicular, 1.0)
+	l1.SetLength(length * height)
 
-		//perpendicular.Reverse()
+	l2 := NewLine2(intersect2, *perpendicular, 1.0)
+	l2.SetLength(length * height)
 
-		l4 := NewLine2(intersect1, *perpendicular, 1.0)
-		l4.SetLength(-length * height)
+	l3 := NewLine3(l1.At(1.0), l2.At(1.0))
 
-		l5 := NewLine2(intersect2, *perpendicular, 1.0)
-		l5.SetLength(-length * height)
+	l4 := NewLine2(intersect1, *perpendicular, 1.0)
+	l4.SetLength(-length * lowerHeight)
 
-		l6 := NewLine3(l4.At(1.0), l5.At(1.0))
+	l5 := NewLine2(intersect2, *perpendicular, 1.0)
+	l5.SetLength(-length * lowerHeight)
 
-		l7 := NewLine3(l.Start, intersect1)
+	l6 := NewLine3(l4.At(1.0), l5.At(1.0))
 
-		l8 := NewLine3(intersect2, l.At(1.0))
+	l7 := NewLine3(l.Start, intersect1)
 
-		doPeanoCurve(s, l1, options, depth-1)
-		doPeanoCurve(s, l2, options, depth-1)
-		doPeanoCurve(s, l3, options, depth-1)
-		doPeanoCurve(s, l4, options, depth-1)
-		doPeanoCurve(s, l5, options, depth-1)
-		doPeanoCurve(s, l6, options, depth-1)
-		doPeanoCurve(s, l7, options, depth-1)
-		doPeanoCurve(s, l8, options, depth-1)
-
-		if options.DisplayCenter {
-			l9 := NewLine3(intersect1, intersect2)
-			doPeanoCurve(s, l9, options, depth-1)
-		}
+	l8 := NewLine3(intersect2, l.At(1.0))
 
+	children := []Line{l1, l2, l3, l4, l5, l6, l7, l8}
+	if options.DisplayCenter {
+		children = append(children, NewLine3(intersect1, intersect2))
 	}
+	return children
 }
 
-func peanoCurve(s *svg.SVG, x1, y1, x2, y2 int, options *PeanoOptions, complexity int) {
-	l := NewLine(float64(x1), float64(y1), float64(x2), float64(y2))
+// Do the fractal, skipping segments that are off the canvas and stopping at segments
+// too small to show more detail, or at every segment once the render is stopped
+func doPeanoCurve(s *svg.SVG, l Line, level int, node uint64, options *PeanoOptions) {
+	if options.viewport.Stopped() {
+		return
+	}
+	screen := l.Transform(options.view)
+	length := math.Abs(screen.Length())
+	if !options.viewport.VisibleDisk(screen.At(0.5), options.bound*length) {
+		return
+	}
+	if level >= options.depth || length < options.viewport.Detail {
+		if options.viewport.VisibleLine(screen) {
+			screen.Render(s)
+		}
+		return
+	}
 
-	doPeanoCurve(s, l, options, complexity)
+	height := options.Height
+	lowerHeight := options.Height
+	if options.Random {
+		height *= 1.0 + options.Jitter*(2.0*nodeRandom(options.seed, node, 0)-1.0)
+		lowerHeight *= 1.0 + options.Jitter*(2.0*nodeRandom(options.seed, node, 1)-1.0)
+	}
+	for i, child := range peanoChildren(l, options, height, lowerHeight) {
+		doPeanoCurve(s, child, level+1, childNode(node, i), options)
+	}
 }
 
-func peanoCurveHandler(w http.ResponseWriter, req *http.Request) {
-	const (
-		defaultComplexity = 5
-		maxComplexity     = 8
-		defaultHeight     = 1.0 / 3.0
-		maxHeight         = 0.5
-		minHeight         = 0.0
-	)
-
-	options := PeanoOptions{}
+// Draw a peano curve along the unit segment (0, 0) - (1, 0), placed on the canvas by view
+// and magnified by the viewport
+func peanoCurve(s *svg.SVG, view *Matrix, vp *Viewport, options *PeanoOptions, complexity int) {
+	l := NewLine(0.0, 0.0, 1.0, 0.0)
+	options.view = MultMatrix(vp.Matrix(), view)
+	options.viewport = vp
 
-	_ = req.ParseForm()
-	complexity, err := strconv.Atoi(req.FormValue("complexity"))
-	if err != nil || complexity < 0 || complexity > maxComplexity {
-		complexity = defaultComplexity
+	maxHeight := options.Height
+	if options.Random {
+		maxHeight *= 1.0 + options.Jitter
 	}
+	options.bound, _ = subdivisionBound(l, peanoChildren(l, options, maxHeight, maxHeight))
+	_, ratio := subdivisionBound(l, peanoChildren(l, options, options.Height, options.Height))
+	options.depth = complexity + vp.Levels(1.0/ratio)
 
-	options.Height, err = strconv.ParseFloat(req.FormValue("height"), 64)
-	if err != nil || options.Height < minHeight || options.Height > maxHeight {
-		options.Height = defaultHeight
-	}
+	doPeanoCurve(s, l, 0, 0, options)
+}
+
+func peanoCurveHandler(w http.ResponseWriter, req *http.Request, v Values) {
+	complexity := v.Int("complexity")
+	maxComplexity := int(v.Max("complexity"))
 
-	center := req.FormValue("center")
-	if center == "true" {
-		options.DisplayCenter = true
+	options := PeanoOptions{
+		Height:        v.Float("height"),
+		DisplayCenter: v.Bool("center"),
+		Random:        v.Bool("random"),
+		Jitter:        v.Float("jitter"),
+		seed:          int64(v.Int("seed")),
 	}
 
 	w.Header().Set("Content-Type", "image/svg+xml")
@@ -460,44 +538,40 @@ func peanoCurveHandler(w http.ResponseWriter, req *http.Request) {
 	s.Start(width, height)
 	defer s.End()
 
-	peanoCurve(s, 0, height/2, width-1, height/2, &options, complexity)
+	peanoCurve(s, canvasSegment(0, height/2, width-1, height/2), NewViewport(v, width, height), &options, complexity)
 }
 
-func dragonCurve(s *svg.SVG, x1, y1, complexity, maxComplexity int) {
-	sys := NewLSystem()
-	sys.FinalizeDragon(complexity)
+// Each level replaces a segment with eight, or nine with the centre drawn
+func peanoCurveEstimate(v Values) Estimate {
+	pieces := 8
+	if v.Bool("center") {
+		pieces = 9
+	}
+	return lineEstimate(powerOf(pieces, v.Int("complexity")))
+}
 
-	steps := sys.String()
-	t := NewTurtle(s)
-	t.SetLocation(Point{X: float64(x1), Y: float64(y1)})
+func dragonCurve(s *svg.SVG, vp *Viewport, x1, y1, complexity, maxComplexity int) {
+	sys := NewLSystem()
+	sys.InitDragon()
+	c := NewLSystemCurve(sys, "F", math.Pi/2.0)
+	base := c.Depth(complexity)
+	depth := c.ZoomDepth(base, vp)
 
 	scale := 10.0 + 2.0*float64(maxComplexity-complexity)
+	view := NewMatrix()
+	view.Translate(float64(x1), float64(y1))
+	view.Scale(scale, scale)
+	// a deeper curve is shrunk and turned to lie over the one for the complexity asked for
+	view.Multiply(c.Similarity(depth, base))
 
-	totalSteps := len(steps)
-	for i := 0; i < totalSteps; i++ {
-		switch steps[i] {
-		case 'F':
-			t.Move(scale)
-		case '+':
-			t.Turn(math.Pi / 2.0)
-		case '-':
-			t.Turn(math.Pi / -2.0)
-		default: // ignore anything else
-		}
-	}
+	t := NewTurtle(s)
+	t.SetTransform(MultMatrix(vp.Matrix(), view))
+	c.Render(t, depth, vp)
 }
 
-func dragonCurveHandler(w http.ResponseWriter, req *http.Request) {
-	const (
-		defaultComplexity = 5
-		maxComplexity     = 16
-	)
-
-	_ = req.ParseForm()
-	complexity, err := strconv.Atoi(req.FormValue("complexity"))
-	if err != nil || complexity < 0 || complexity > maxComplexity {
-		complexity = defaultComplexity
-	}
+func dragonCurveHandler(w http.ResponseWriter, req *http.Request, v Values) {
+	complexity := v.Int("complexity")
+	maxComplexity := int(v.Max("complexity"))
 
 	w.Header().Set("Content-Type", "image/svg+xml")
 	s := svg.New(w)
@@ -508,50 +582,34 @@ func dragonCurveHandler(w http.ResponseWriter, req *http.Request) {
 	s.Start(width, height)
 	defer s.End()
 
-	dragonCurve(s, width/2, height/2, complexity, maxComplexity)
+	dragonCurve(s, NewViewport(v, width, height), width/2, height/2, complexity, maxComplexity)
 }
 
-func plant1Curve(s *svg.SVG, x1, y1, complexity, maxComplexity int) {
-	sys := NewLSystem()
-	sys.FinalizePlant1(complexity)
+func dragonCurveEstimate(v Values) Estimate {
+	return lsystemEstimate((*LSystem).InitDragon, "F", v.Int("complexity"))
+}
 
-	steps := sys.String()
-	t := NewTurtle(s)
-	t.SetLocation(Point{X: float64(x1), Y: float64(y1)})
+func plant1Curve(s *svg.SVG, vp *Viewport, x1, y1, complexity int) {
+	sys := NewLSystem()
+	sys.InitPlant1()
+	c := NewLSystemCurve(sys, "F", (25.0*math.Pi*2.0)/360.0)
+	base := c.Depth(complexity)
+	depth := c.ZoomDepth(base, vp)
 
 	scale := 5.0
+	view := NewMatrix()
+	view.Translate(float64(x1), float64(y1))
+	view.Scale(scale, scale)
+	view.Multiply(c.Similarity(depth, base))
 
-	angle := (25.0 * math.Pi * 2.0) / 360.0
-
-	totalSteps := len(steps)
-	for i := 0; i < totalSteps; i++ {
-		switch steps[i] {
-		case 'F':
-			t.Move(scale)
-		case '+':
-			t.Turn(angle)
-		case '-':
-			t.Turn(-angle)
-		case '[':
-			t.PushState()
-		case ']':
-			t.PopState()
-		default: // ignore anything else
-		}
-	}
+	t := NewTurtle(s)
+	t.SetTransform(MultMatrix(vp.Matrix(), view))
+	c.Render(t, depth, vp)
 }
 
-func plant1Handler(w http.ResponseWriter, req *http.Request) {
-	const (
-		defaultComplexity = 5
-		maxComplexity     = 12
-	)
-
-	_ = req.ParseForm()
-	complexity, err := strconv.Atoi(req.FormValue("complexity"))
-	if err != nil || complexity < 0 || complexity > maxComplexity {
-		complexity = defaultComplexity
-	}
+func plant1Handler(w http.ResponseWriter, req *http.Request, v Values) {
+	complexity := v.Int("complexity")
+	maxComplexity := int(v.Max("complexity"))
 
 	w.Header().Set("Content-Type", "image/svg+xml")
 	s := svg.New(w)
@@ -562,15 +620,17 @@ func plant1Handler(w http.ResponseWriter, req *http.Request) {
 	s.Start(width, height)
 	defer s.End()
 
-	plant1Curve(s, width/5, height-(height/5), complexity, maxComplexity)
+	plant1Curve(s, NewViewport(v, width, height), width/5, height-(height/5), complexity)
+}
+
+func plant1Estimate(v Values) Estimate {
+	return lsystemEstimate((*LSystem).InitPlant1, "F", v.Int("complexity"))
 }
 
 func indexHandler(w http.ResponseWriter, req *http.Request) {
-	m := make(map[string]string)
-	m[""] = ""
 	t, ok := templates["index"]
 	if ok {
-		if err := t.Execute(w, &m); err != nil {
+		if err := t.Execute(w, fractalGroups()); err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 		}
 		return
@@ -579,7 +639,7 @@ func indexHandler(w http.ResponseWriter, req *http.Request) {
 }
 
 func initTemplates() {
-	for _, name := range []string{"index"} {
+	for _, name := range []string{"index", "tiles"} {
 		fileName := fmt.Sprintf("templates/%s.html", name)
 		templates[name] = NewTemplate(fileName)
 	}
@@ -591,25 +651,37 @@ func main() {
 	initTemplates()
 
 	fmt.Println("Starting server at localhost port 8080")
-	fmt.Println("\nKoch curves/waves:")
-	fmt.Println("Pass the following url parameters:")
-	fmt.Println("complexity=n (where n in an integer in [0,9]")
-	fmt.Println("pi=n (where n is a real number [-1.0, 1.0])")
-	fmt.Println("\nPeano curves:")
-	fmt.Println("complexity=n (where n is an integer in [0,9])")
-	fmt.Println("height=n (where n is a real number [0.0, 1.0])")
-
-	fmt.Println("\nDragon curves:")
-	fmt.Println("complexity=n (where n is an integer in [0,16]")
+	fmt.Println("\nPass the following url parameters, leaving any out to use its default:")
+	printUsage(os.Stdout)
+
+	fmt.Println("\nFlame definitions are JSON objects of the form:")
+	fmt.Println("  transforms: [{coefs: [a,b,c,d,e,f], weight, color, variations: {name: weight}}]")
+	fmt.Println("  variations: linear, sinusoidal, spherical, swirl, horseshoe, polar, heart, disc")
+	fmt.Println("  palette, width, height, center: [x,y], scale, quality, gamma, brightness, seed")
+	fmt.Println("and may also be POSTed to /flame/ as the request body")
+	fmt.Println("\nEvery fractal and its parameters are listed as JSON at /api/fractals, and")
+	fmt.Println("may be drawn by POSTing {\"fractal\": name, \"params\": {...}} to /api/render")
+	fmt.Println("\nThe curves that can be zoomed are also served as map tiles at")
+	fmt.Println("/tiles/{fractal}/{z}/{x}/{y}.svg or .png, and may be browsed at /tiles/{fractal}/")
+	fmt.Println("\nHow much a fractal would draw is reported at /estimate?fractal=name&params..., and")
+	fmt.Printf("anything over %.3g segments or %.3g bytes is refused\n", *maxSegments, *maxBytes)
+	fmt.Printf("\nAt most %d pictures are drawn at once, up to %d for one client, with the rest\n", *maxRenders, *maxClientRenders)
+	fmt.Printf("waiting up to %v before being told to retry\n", *maxWait)
+	fmt.Println("\nFinished pictures are cached by their parameters, and carry an ETag so a")
+	fmt.Println("browser already holding one is answered with 304 Not Modified")
+	fmt.Println("\nResponses are gzipped for clients that accept it, and format=svgz downloads")
+	fmt.Println("any svg fractal as a gzipped .svgz file")
 
 	http.Handle("/", http.HandlerFunc(indexHandler))
-	http.Handle("/linear/koch/curve/", http.HandlerFunc(kochCurveHandler))
-	http.Handle("/linear/koch/snowflake/", http.HandlerFunc(kochSnowflakeHandler))
-	http.Handle("/linear/peano/curve/", http.HandlerFunc(peanoCurveHandler))
-	http.Handle("/linear/dragon/curve/", http.HandlerFunc(dragonCurveHandler))
-	http.Handle("/linear/plant1/", http.HandlerFunc(plant1Handler))
+	for _, f := range fractals {
+		http.Handle(f.Path, f)
+	}
+	http.Handle("/api/fractals", http.HandlerFunc(apiFractalsHandler))
+	http.Handle("/api/render", http.HandlerFunc(apiRenderHandler))
+	http.Handle("/tiles/", http.HandlerFunc(tileHandler))
+	http.Handle("/estimate", http.HandlerFunc(estimateHandler))
 
-	err := http.ListenAndServe(*addr, nil)
+	err := http.ListenAndServe(*addr, gzipHandler(http.DefaultServeMux))
 	if err != nil {
 		fmt.Println("Error: ", err)
 	}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/ajstarks/svgo"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	tileSize    = 256 // pixels across a tile
+	maxTileZoom = 40  // the deepest zoom level served, a magnification of about 1e12
+)
+
+// A map tile.  At zoom level Z the square holding the image is cut into 2^Z x 2^Z tiles,
+// numbered from the top left.
+type MapTile struct {
+	Z, X, Y int
+}
+
+// Return the viewport drawing the tile of an image whose unzoomed size is width x height.
+// The image is centred in the square covered by the single tile of zoom level 0.
+func (t *MapTile) Viewport(width, height, detail float64) *Viewport {
+	world := math.Max(width, height)
+	side := world / math.Exp2(float64(t.Z)) // of the tile, in unzoomed pixels
+	zoom := tileSize / side
+
+	vp := &Viewport{Width: tileSize, Height: tileSize, Zoom: zoom, Detail: detail, view: NewMatrix()}
+	vp.view.Scale(zoom, zoom)
+	vp.view.Translate((world-width)/2.0-float64(t.X)*side, (world-height)/2.0-float64(t.Y)*side)
+	return vp
+}
+
+// Whether the fractal can be drawn as map tiles, which needs it to draw through a viewport
+func (f *Fractal) Zoomable() bool {
+	for _, name := range []string{"x", "y", "zoom", "detail"} {
+		if f.Param(name) == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// A response held in memory, so a tile can be rewritten and cached before it is sent
+type bufferedResponse struct {
+	header http.Header
+	body   bytes.Buffer
+}
+
+func (r *bufferedResponse) Header() http.Header         { return r.header }
+func (r *bufferedResponse) Write(b []byte) (int, error) { return r.body.Write(b) }
+func (r *bufferedResponse) WriteHeader(status int)      {}
+
+// Parse a tile's z, x and y, with the image format given by the extension of y
+func parseTile(z, x, y string) (*MapTile, string, error) {
+	format := ""
+	if i := strings.LastIndex(y, "."); i >= 0 {
+		y, format = y[:i], y[i+1:]
+	}
+	if format != "svg" && format != "png" {
+		return nil, "", errors.New("a tile must end in .svg or .png")
+	}
+
+	var t MapTile
+	var err error
+	if t.Z, err = strconv.Atoi(z); err != nil || t.Z < 0 || t.Z > maxTileZoom {
+		return nil, "", fmt.Errorf("the zoom level must be an integer in [0, %d]", maxTileZoom)
+	}
+	n := 1 << uint(t.Z)
+	if t.X, err = strconv.Atoi(x); err != nil || t.X < 0 || t.X >= n {
+		return nil, "", fmt.Errorf("x must be an integer in [0, %d]", n-1)
+	}
+	if t.Y, err = strconv.Atoi(y); err != nil || t.Y < 0 || t.Y >= n {
+		return nil, "", fmt.Errorf("y must be an integer in [0, %d]", n-1)
+	}
+	return &t, format, nil
+}
+
+// Return the directory caching a fractal's tiles for the given parameters.  The
+// viewport's own position and the format are left out, as drawing a tile ignores them.
+func tileCacheDir(v Values) string {
+	return filepath.Join(*tileDir, v.fractal.Name, v.Hash("x", "y", "zoom", "format")[:32])
+}
+
+// Return the key caching a tile drawn in the given format
+func tileKey(v Values, tile *MapTile, format string) string {
+	h := sha256.Sum256([]byte(fmt.Sprintf("%s/%d/%d/%d.%s", v.Hash("x", "y", "zoom", "format"), tile.Z, tile.X, tile.Y, format)))
+	return hex.EncodeToString(h[:])
+}
+
+// Write a file so that it appears whole or not at all
+func writeFileAtomic(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// Serve /tiles/{fractal}/{z}/{x}/{y}.svg or .png, a map tile of the fractal drawn with
+// the parameters in the url, or /tiles/{fractal}/, a page for browsing them
+func tileHandler(w http.ResponseWriter, req *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(req.URL.Path, "/tiles/"), "/")
+	f := findFractal(parts[0])
+	if f == nil || !f.Zoomable() || (len(parts) != 2 && len(parts) != 4) || (len(parts) == 2 && parts[1] != "") {
+		writeJSONErrors(w, http.StatusNotFound, []FieldError{{Message: "no such tile, use /tiles/{fractal}/{z}/{x}/{y}.svg or .png"}})
+		return
+	}
+
+	v, problems := f.Parse(req)
+	if len(problems) > 0 {
+		writeJSONErrors(w, http.StatusBadRequest, problems)
+		return
+	}
+	if len(parts) == 2 {
+		tileViewerHandler(w, req, f)
+		return
+	}
+	tile, format, err := parseTile(parts[1], parts[2], parts[3])
+	if err != nil {
+		paramError(w, "tile", err)
+		return
+	}
+
+	serveCached(w, req, tileKey(v, tile, format), func(w http.ResponseWriter) error {
+		serveTile(w, req, f, v, tile, format)
+		return nil
+	})
+}
+
+// Draw a tile, or read it from the -tiles directory if it was drawn before.  A tile
+// that can't be finished is answered with an error, so it is never cached.
+func serveTile(w http.ResponseWriter, req *http.Request, f *Fractal, v Values, tile *MapTile, format string) {
+	contentType := "image/" + format
+	if format == "svg" {
+		contentType = "image/svg+xml"
+	}
+	w.Header().Set("Content-Type", contentType)
+
+	path := ""
+	if *tileDir != "" {
+		path = filepath.Join(tileCacheDir(v), strconv.Itoa(tile.Z), strconv.Itoa(tile.X), strconv.Itoa(tile.Y)+"."+format)
+		if data, err := os.ReadFile(path); err == nil {
+			w.Write(data)
+			return
+		}
+	}
+
+	v.tile = tile
+	e := f.estimate(v)
+	if problems := checkBudget(e); problems != nil {
+		writeJSONErrors(w, http.StatusRequestEntityTooLarge, problems)
+		return
+	}
+	release := admit(w, req, e)
+	if release == nil {
+		return
+	}
+	defer release()
+	drawn := &bufferedResponse{header: make(http.Header)}
+	if err := f.draw(drawn, req, v); err != nil {
+		writeJSONErrors(w, http.StatusServiceUnavailable, []FieldError{{Message: "the tile was not finished as " + stopReason(err)}})
+		return
+	}
+
+	var data bytes.Buffer
+	var err error
+	if format == "png" {
+		err = tilePNG(&data, drawn.body.Bytes())
+	} else {
+		tileSVG(&data, drawn.body.Bytes())
+	}
+	if err != nil {
+		writeJSONErrors(w, http.StatusInternalServerError, []FieldError{{Message: err.Error()}})
+		return
+	}
+	if path != "" {
+		// a tile that can't be cached is still served
+		_ = writeFileAtomic(path, data.Bytes())
+	}
+	w.Write(data.Bytes())
+}
+
+// Write the tile drawn on the fractal's full sized canvas as a tile sized image
+func tileSVG(w io.Writer, drawn []byte) {
+	if i := bytes.Index(drawn, []byte("<svg")); i >= 0 {
+		drawn = drawn[i:]
+	}
+	s := svg.New(w)
+	s.Start(tileSize, tileSize)
+	w.Write(drawn)
+	s.End()
+}
+
+var svgLine = regexp.MustCompile(`<line x1="(-?\d+)" y1="(-?\d+)" x2="(-?\d+)" y2="(-?\d+)"`)
+
+// Draw the lines of the tile drawn on the fractal's full sized canvas as a png
+func tilePNG(w io.Writer, drawn []byte) error {
+	img := newGrayImage(tileSize, tileSize)
+	for _, m := range svgLine.FindAllSubmatch(drawn, -1) {
+		var p [4]float64
+		for i := range p {
+			p[i], _ = strconv.ParseFloat(string(m[i+1]), 64)
+		}
+		drawLine(img, Point{X: p[0], Y: p[1]}, Point{X: p[2], Y: p[3]})
+	}
+	return png.Encode(w, img)
+}
+
+// Create a white image
+func newGrayImage(width, height int) *image.Gray {
+	img := image.NewGray(image.Rect(0, 0, width, height))
+	draw.Draw(img, img.Bounds(), image.White, image.Point{}, draw.Src)
+	return img
+}
+
+// Draw a black line one pixel wide, clipped to the image
+func drawLine(img *image.Gray, a, b Point) {
+	bounds := img.Bounds()
+	a, b, ok := clipLine(a, b, float64(bounds.Max.X-1), float64(bounds.Max.Y-1))
+	if !ok {
+		return
+	}
+
+	// Bresenham's algorithm
+	x1, y1, x2, y2 := int(a.X), int(a.Y), int(b.X), int(b.Y)
+	dx, dy := x2-x1, -(y2 - y1)
+	if dx < 0 {
+		dx = -dx
+	}
+	if dy > 0 {
+		dy = -dy
+	}
+	sx, sy := 1, 1
+	if x1 > x2 {
+		sx = -1
+	}
+	if y1 > y2 {
+		sy = -1
+	}
+	e := dx + dy
+	for {
+		img.SetGray(x1, y1, color.Gray{})
+		if x1 == x2 && y1 == y2 {
+			return
+		}
+		// both steps are decided by the error before either is taken
+		e2 := 2 * e
+		if e2 >= dy {
+			e += dy
+			x1 += sx
+		}
+		if e2 <= dx {
+			e += dx
+			y1 += sy
+		}
+	}
+}
+
+// Clip the line from a to b to the box from (0, 0) to (maxX, maxY), returning false if
+// none of it is inside
+func clipLine(a, b Point, maxX, maxY float64) (Point, Point, bool) {
+	// Liang-Barsky, keeping the part of a + t(b - a) with t in [low, high]
+	dx, dy := b.X-a.X, b.Y-a.Y
+	low, high := 0.0, 1.0
+	for _, edge := range [][2]float64{{-dx, a.X}, {dx, maxX - a.X}, {-dy, a.Y}, {dy, maxY - a.Y}} {
+		p, q := edge[0], edge[1]
+		if p == 0.0 {
+			if q < 0.0 {
+				return a, b, false
+			}
+			continue
+		}
+		t := q / p
+		if p < 0.0 {
+			low = math.Max(low, t)
+		} else {
+			high = math.Min(high, t)
+		}
+	}
+	if low > high {
+		return a, b, false
+	}
+	return Point{X: math.Round(a.X + low*dx), Y: math.Round(a.Y + low*dy)}, Point{X: math.Round(a.X + high*dx), Y: math.Round(a.Y + high*dy)}, true
+}
+
+// The page browsing a fractal's tiles
+type tileViewer struct {
+	Fractal  *Fractal
+	Query    string // the fractal's parameters, passed on to every tile
+	TileSize int
+	MaxZoom  int
+}
+
+func tileViewerHandler(w http.ResponseWriter, req *http.Request, f *Fractal) {
+	t, ok := templates["tiles"]
+	if ok {
+		if err := t.Execute(w, tileViewer{Fractal: f, Query: req.URL.RawQuery, TileSize: tileSize, MaxZoom: maxTileZoom}); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	http.Error(w, "Missing template file", http.StatusInternalServerError)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"image"
+	"testing"
+	"time"
+)
+
+// Count the black pixels of an image
+func blackPixels(img *image.Gray) int {
+	n := 0
+	for _, p := range img.Pix {
+		if p == 0 {
+			n++
+		}
+	}
+	return n
+}
+
+func TestDrawLine(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		a, b   Point
+		pixels int
+	}{
+		{"shallow", Point{X: 2, Y: 3}, Point{X: 40, Y: 10}, 39},
+		{"steep", Point{X: 3, Y: 2}, Point{X: 10, Y: 40}, 39},
+		{"steep backwards", Point{X: 10, Y: 40}, Point{X: 3, Y: 2}, 39},
+		{"diagonal", Point{X: 0, Y: 63}, Point{X: 63, Y: 0}, 64},
+		{"half slope", Point{X: 0, Y: 0}, Point{X: 2, Y: 1}, 3},
+		{"near diagonal", Point{X: 10, Y: 10}, Point{X: 16, Y: 15}, 7},
+		{"near diagonal backwards", Point{X: 16, Y: 15}, Point{X: 10, Y: 10}, 7},
+		{"point", Point{X: 5, Y: 5}, Point{X: 5, Y: 5}, 1},
+		{"clipped", Point{X: -100, Y: 32}, Point{X: 200, Y: 32}, 64},
+		{"clipped steep", Point{X: 20, Y: -500}, Point{X: 30, Y: 500}, 64},
+		{"outside", Point{X: -10, Y: -10}, Point{X: -1, Y: 100}, 0},
+	} {
+		img := newGrayImage(64, 64)
+		done := make(chan bool)
+		go func() {
+			drawLine(img, c.a, c.b)
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatalf("%s: drawing the line from %v to %v did not finish", c.name, c.a, c.b)
+		}
+		if n := blackPixels(img); n != c.pixels {
+			t.Errorf("%s: drew %d pixels, expected %d", c.name, n, c.pixels)
+		}
+	}
+}
+
+func TestClipLine(t *testing.T) {
+	for _, c := range []struct {
+		a, b, clippedA, clippedB Point
+		ok                       bool
+	}{
+		{Point{X: 1, Y: 2}, Point{X: 3, Y: 4}, Point{X: 1, Y: 2}, Point{X: 3, Y: 4}, true},
+		{Point{X: -10, Y: 5}, Point{X: 20, Y: 5}, Point{X: 0, Y: 5}, Point{X: 10, Y: 5}, true},
+		{Point{X: 5, Y: 20}, Point{X: 5, Y: -10}, Point{X: 5, Y: 10}, Point{X: 5, Y: 0}, true},
+		{Point{X: -5, Y: -5}, Point{X: 15, Y: 15}, Point{X: 0, Y: 0}, Point{X: 10, Y: 10}, true},
+		{Point{X: -5, Y: 0}, Point{X: 0, Y: -5}, Point{}, Point{}, false},
+		{Point{X: 11, Y: 0}, Point{X: 11, Y: 10}, Point{}, Point{}, false},
+	} {
+		a, b, ok := clipLine(c.a, c.b, 10, 10)
+		if ok != c.ok || (ok && (a != c.clippedA || b != c.clippedB)) {
+			t.Errorf("clipping %v to %v gave %v to %v (%v), expected %v to %v (%v)", c.a, c.b, a, b, ok, c.clippedA, c.clippedB, c.ok)
+		}
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"github.com/ajstarks/svgo"
+	"math"
+	"net/http"
+)
+
+// Upper bound on the number of tiles a tiling may draw
+const maxTiles = 1 << 17
+
+var goldenRatio = (1.0 + math.Sqrt(5.0)) / 2.0
+
+// A tile of a substitution tiling, or for the penrose tilings half of one.  Kind
+// picks the colour the tile is filled with.
+type Tile struct {
+	Kind   int
+	Points []Point
+}
+
+// A tiling built by repeatedly replacing each tile with smaller tiles
+type Tiling struct {
+	Start             func(size float64) []Tile // tiles covering a size x size canvas
+	Subdivide         func(t Tile) []Tile
+	Outline           func(t Tile) []Point // the edges of the tile to stroke
+	Pieces            int                  // the most tiles each tile is replaced with
+	DefaultComplexity int
+}
+
+var (
+	penroseKites = &Tiling{
+		Start:             penroseSun,
+		Subdivide:         subdivideKitesDarts,
+		Outline:           func(t Tile) []Point { return t.Points },
+		Pieces:            3,
+		DefaultComplexity: 6,
+	}
+	penroseRhombs = &Tiling{
+		Start:             penroseSun,
+		Subdivide:         subdivideRhombs,
+		Outline:           func(t Tile) []Point { return []Point{t.Points[2], t.Points[0], t.Points[1]} },
+		Pieces:            3,
+		DefaultComplexity: 6,
+	}
+	pinwheel = &Tiling{
+		Start:             pinwheelStart,
+		Subdivide:         subdividePinwheel,
+		Outline:           func(t Tile) []Point { return []Point{t.Points[0], t.Points[1], t.Points[2], t.Points[0]} },
+		Pieces:            5,
+		DefaultComplexity: 4,
+	}
+)
+
+// Return the point a fraction t of the way from p to q
+func between(p, q Point, t float64) Point {
+	return NewLine3(p, q).At(t)
+}
+
+// A wheel of ten golden triangles around the centre of the canvas, large enough to
+// cover its corners.  Each triangle is (apex, B, C) with a 36 degree apex, and
+// neighbours are mirrored so they share their A-C edges.
+func penroseSun(size float64) []Tile {
+	centre := Point{X: size / 2.0, Y: size / 2.0}
+	radius := size * 0.75
+	tiles := make([]Tile, 10)
+	for i := range tiles {
+		b := float64(2*i-1) * math.Pi / 10.0
+		c := float64(2*i+1) * math.Pi / 10.0
+		if i%2 == 0 {
+			b, c = c, b
+		}
+		tiles[i] = Tile{Kind: 0, Points: []Point{
+			centre,
+			{X: centre.X + radius*math.Cos(b), Y: centre.Y + radius*math.Sin(b)},
+			{X: centre.X + radius*math.Cos(c), Y: centre.Y + radius*math.Sin(c)},
+		}}
+	}
+	return tiles
+}
+
+// Deflate half a kite or dart.  A half kite (kind 0) is (tip, side, blunt corner)
+// and a half dart (kind 1) is (tip, side, reflex corner), both split along A-C.
+func subdivideKitesDarts(t Tile) []Tile {
+	a, b, c := t.Points[0], t.Points[1], t.Points[2]
+	if t.Kind == 0 {
+		p := between(a, b, 1.0/goldenRatio)
+		q := between(c, a, 1.0/goldenRatio)
+		return []Tile{
+			{Kind: 0, Points: []Point{c, b, p}},
+			{Kind: 0, Points: []Point{c, q, p}},
+			{Kind: 1, Points: []Point{a, p, q}},
+		}
+	}
+	p := between(b, a, 1.0/goldenRatio)
+	return []Tile{
+		{Kind: 0, Points: []Point{b, c, p}},
+		{Kind: 1, Points: []Point{a, c, p}},
+	}
+}
+
+// Deflate half a rhomb.  A half thin rhomb (kind 0) has a 36 degree angle at A and a
+// half thick rhomb (kind 1) a 108 degree angle at A, both split along B-C.
+func subdivideRhombs(t Tile) []Tile {
+	a, b, c := t.Points[0], t.Points[1], t.Points[2]
+	if t.Kind == 0 {
+		p := between(a, b, 1.0/goldenRatio)
+		return []Tile{
+			{Kind: 0, Points: []Point{c, p, b}},
+			{Kind: 1, Points: []Point{p, c, a}},
+		}
+	}
+	q := between(b, a, 1.0/goldenRatio)
+	r := between(b, c, 1.0/goldenRatio)
+	return []Tile{
+		{Kind: 1, Points: []Point{r, c, a}},
+		{Kind: 1, Points: []Point{q, r, b}},
+		{Kind: 0, Points: []Point{r, q, a}},
+	}
+}
+
+// Return a pinwheel tile (right angle, end of the long leg, end of the short leg),
+// with its kind set by which way round it is
+func pinwheelTile(r, l, s Point) Tile {
+	kind := 0
+	if (l.X-r.X)*(s.Y-r.Y)-(l.Y-r.Y)*(s.X-r.X) < 0.0 {
+		kind = 1
+	}
+	return Tile{Kind: kind, Points: []Point{r, l, s}}
+}
+
+// Two 1:2 right triangles making a 2x1 rectangle, the canvas covers its middle
+func pinwheelStart(size float64) []Tile {
+	p00 := Point{X: -size / 2.0, Y: 0.0}
+	p10 := Point{X: size * 1.5, Y: 0.0}
+	p11 := Point{X: size * 1.5, Y: size}
+	p01 := Point{X: -size / 2.0, Y: size}
+	return []Tile{pinwheelTile(p00, p10, p01), pinwheelTile(p11, p01, p10)}
+}
+
+// Replace a 1:2 right triangle with five copies scaled by 1/sqrt(5).  The foot of the
+// altitude cuts off one copy, the rest is twice a copy and splits at its midpoints.
+func subdividePinwheel(t Tile) []Tile {
+	r, l, s := t.Points[0], t.Points[1], t.Points[2]
+	e := between(l, s, 0.8)
+
+	// the larger triangle has its right angle at e, long leg e-l and short leg e-r
+	rl := between(e, l, 0.5)
+	ls := between(l, r, 0.5)
+	rs := between(e, r, 0.5)
+	return []Tile{
+		pinwheelTile(e, r, s),
+		pinwheelTile(e, rl, rs),
+		pinwheelTile(rl, l, ls),
+		pinwheelTile(rs, ls, r),
+		pinwheelTile(ls, rs, rl),
+	}
+}
+
+// Return whether any of the tile's bounding box lies on the canvas
+func onCanvas(t Tile, size float64) bool {
+	low, high := treeBounds([]treePart{{Points: t.Points}})
+	return high.X >= 0.0 && high.Y >= 0.0 && low.X <= size && low.Y <= size
+}
+
+// Do the tiling, replacing the tile depth times and dropping any tiles that fall
+// outside the canvas, since everything they are replaced with does too
+func doTiling(tiles []Tile, tiling *Tiling, t Tile, size float64, depth int) []Tile {
+	if !onCanvas(t, size) {
+		return tiles
+	}
+	if depth <= 0 {
+		return append(tiles, t)
+	}
+	for _, piece := range tiling.Subdivide(t) {
+		tiles = doTiling(tiles, tiling, piece, size, depth-1)
+	}
+	return tiles
+}
+
+// Draw the tiling, filling each tile by its kind then stroking its outline
+func renderTiling(s *svg.SVG, tiling *Tiling, complexity, size int, colors []string) {
+	var tiles []Tile
+	for _, t := range tiling.Start(float64(size)) {
+		tiles = doTiling(tiles, tiling, t, float64(size), complexity)
+	}
+
+	for _, t := range tiles {
+		// stroke with the fill colour as well to hide the seams between halves
+		c := colors[t.Kind%len(colors)]
+		renderPolygon(s, t.Points, "fill:"+c+";stroke:"+c)
+	}
+	for _, t := range tiles {
+		outline := tiling.Outline(t)
+		x := make([]int, len(outline))
+		y := make([]int, len(outline))
+		for i, p := range outline {
+			x[i], y[i] = int(p.X), int(p.Y)
+		}
+		s.Polyline(x, y, "fill:none;stroke:black")
+	}
+}
+
+// Create a handler drawing the given tiling
+func tilingHandler(tiling *Tiling) RenderFunc {
+	return func(w http.ResponseWriter, req *http.Request, v Values) {
+		const size = 1000
+
+		complexity := v.Int("complexity")
+		colors, err := bandColors(v.String("palette"), 2)
+		if err != nil {
+			paramError(w, "palette", err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "image/svg+xml")
+		s := svg.New(w)
+		s.Start(size, size)
+		defer s.End()
+
+		renderTiling(s, tiling, complexity, size, colors)
+	}
+}
+
+// Create the estimate for drawing the given tiling, each tile being filled and then
+// outlined
+func tilingEstimate(tiling *Tiling) EstimateFunc {
+	return func(v Values) Estimate {
+		start := tiling.Start(1.0)
+		tiles := float64(len(start)) * powerOf(tiling.Pieces, v.Int("complexity"))
+		return polygonEstimate(2.0*tiles, len(start[0].Points))
+	}
+}
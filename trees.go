@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"github.com/ajstarks/svgo"
+	"math"
+	"net/http"
+)
+
+// Upper bound on the number of branches a tree may draw
+const maxTreeBranches = 1 << 17
+
+// A polygon or line making up part of a tree, along with the level it was drawn at
+type treePart struct {
+	Points []Point
+	Width  float64
+	Level  int
+}
+
+// The shape of a binary tree.  Each level the branches are scaled by LengthDecay,
+// spread by AngleDecay and thinned by ThicknessDecay.
+type BinaryTreeOptions struct {
+	Angle          float64 // in radians, between each branch and its parent
+	LengthDecay    float64
+	AngleDecay     float64
+	Thickness      float64 // the width of the trunk, as a fraction of its length
+	ThicknessDecay float64
+}
+
+// Return the bounding box of the parts of a tree
+func treeBounds(parts []treePart) (low, high Point) {
+	low = Point{X: math.Inf(1), Y: math.Inf(1)}
+	high = Point{X: math.Inf(-1), Y: math.Inf(-1)}
+	for _, part := range parts {
+		for _, p := range part.Points {
+			low.X, low.Y = math.Min(low.X, p.X), math.Min(low.Y, p.Y)
+			high.X, high.Y = math.Max(high.X, p.X), math.Max(high.Y, p.Y)
+		}
+	}
+	return low, high
+}
+
+// Do the fractal, add the square standing on l and the two trees standing on its top
+// edge.  angle is the angle at the left corner of the triangle joining the two trees.
+func doPythagorasTree(parts []treePart, l Line, angle float64, depth, level int) []treePart {
+	up := cross(l.Direction)
+	up.X *= l.Scale
+	up.Y *= l.Scale
+	p1, p2 := l.At(0.0), l.At(1.0)
+	p3 := Point{X: p2.X + up.X, Y: p2.Y + up.Y}
+	p4 := Point{X: p1.X + up.X, Y: p1.Y + up.Y}
+	parts = append(parts, treePart{Points: []Point{p1, p2, p3, p4}, Level: level})
+	if depth <= 0 {
+		return parts
+	}
+
+	// the triangle on top is right angled, so its left side is cos(angle) of the base
+	m := NewMatrix()
+	m.Rotate(-angle)
+	side := m.ApplyVector(l.Direction)
+	left := NewLine2(p4, side, l.Scale*math.Cos(angle))
+	apex := left.At(1.0)
+
+	parts = doPythagorasTree(parts, left, angle, depth-1, level+1)
+	return doPythagorasTree(parts, NewLine3(apex, p3), angle, depth-1, level+1)
+}
+
+// Do the fractal, add the branch l and the two branches growing from its end
+func doBinaryTree(parts []treePart, l Line, width, angle float64, options *BinaryTreeOptions, depth, level int) []treePart {
+	parts = append(parts, treePart{Points: []Point{l.At(0.0), l.At(1.0)}, Width: width, Level: level})
+	if depth <= 0 {
+		return parts
+	}
+
+	for _, turn := range []float64{-angle, angle} {
+		m := NewMatrix()
+		m.Rotate(turn)
+		branch := NewLine2(l.At(1.0), m.ApplyVector(l.Direction), l.Scale*options.LengthDecay)
+		parts = doBinaryTree(parts, branch, width*options.ThicknessDecay, angle*options.AngleDecay, options, depth-1, level+1)
+	}
+	return parts
+}
+
+// Do the fractal, add a segment of the given length centred on centre, then an
+// H-tree at each end turned a quarter turn and shrunk by 1/sqrt(2)
+func doHTree(parts []treePart, centre Point, length float64, horizontal bool, depth, level int) []treePart {
+	half := Vector{Point{X: length / 2.0}}
+	if !horizontal {
+		half = Vector{Point{Y: length / 2.0}}
+	}
+	start := Point{X: centre.X - half.X, Y: centre.Y - half.Y}
+	end := Point{X: centre.X + half.X, Y: centre.Y + half.Y}
+	parts = append(parts, treePart{Points: []Point{start, end}, Level: level})
+	if depth <= 0 {
+		return parts
+	}
+
+	parts = doHTree(parts, start, length/math.Sqrt2, !horizontal, depth-1, level+1)
+	return doHTree(parts, end, length/math.Sqrt2, !horizontal, depth-1, level+1)
+}
+
+// Draw the parts of a tree, scaled to fill the canvas and coloured by level
+func renderTree(s *svg.SVG, parts []treePart, levels, size, margin int, filled bool) error {
+	colors, err := bandColors("forest", levels+1)
+	if err != nil {
+		return err
+	}
+
+	low, high := treeBounds(parts)
+	view := NewFitMatrix(low, high, float64(size), float64(margin))
+	scale := math.Sqrt(math.Abs(view.Determinant()))
+
+	for _, part := range parts {
+		points := make([]Point, len(part.Points))
+		for i, p := range part.Points {
+			points[i] = view.Apply(p)
+		}
+		if filled {
+			renderPolygon(s, points, "stroke:none;fill:"+colors[part.Level])
+		} else {
+			width := math.Max(1.0, part.Width*scale)
+			NewLine3(points[0], points[1]).RenderStyle(s, fmt.Sprintf("fill:none;stroke-linecap:round;stroke:%s;stroke-width:%.1f", colors[part.Level], width))
+		}
+	}
+	return nil
+}
+
+// Convert an angle in degrees to radians
+func radians(degrees float64) float64 {
+	return degrees * math.Pi / 180.0
+}
+
+func pythagorasTreeHandler(w http.ResponseWriter, req *http.Request, v Values) {
+	const (
+		size   = 1000
+		margin = 20
+	)
+
+	complexity := v.Int("complexity")
+	angle := radians(v.Float("angle"))
+
+	parts := doPythagorasTree(nil, NewLine(0.0, 0.0, 1.0, 0.0), angle, complexity, 0)
+
+	w.Header().Set("Content-Type", "image/svg+xml")
+	s := svg.New(w)
+	s.Start(size, size)
+	defer s.End()
+
+	if err := renderTree(s, parts, complexity, size, margin, true); err != nil {
+		fmt.Println("Error rendering tree: ", err)
+	}
+}
+
+func binaryTreeHandler(w http.ResponseWriter, req *http.Request, v Values) {
+	const (
+		size   = 1000
+		margin = 20
+	)
+
+	complexity := v.Int("complexity")
+	options := &BinaryTreeOptions{
+		Angle:          radians(v.Float("angle")),
+		LengthDecay:    v.Float("length"),
+		AngleDecay:     v.Float("spread"),
+		Thickness:      v.Float("thickness"),
+		ThicknessDecay: v.Float("thinning"),
+	}
+
+	trunk := NewLine(0.0, 0.0, 0.0, -1.0)
+	parts := doBinaryTree(nil, trunk, options.Thickness, options.Angle, options, complexity, 0)
+
+	w.Header().Set("Content-Type", "image/svg+xml")
+	s := svg.New(w)
+	s.Start(size, size)
+	defer s.End()
+
+	if err := renderTree(s, parts, complexity, size, margin, false); err != nil {
+		fmt.Println("Error rendering tree: ", err)
+	}
+}
+
+func hTreeHandler(w http.ResponseWriter, req *http.Request, v Values) {
+	const (
+		size   = 1000
+		margin = 20
+	)
+
+	complexity := v.Int("complexity")
+
+	parts := doHTree(nil, Point{}, 1.0, true, complexity, 0)
+
+	w.Header().Set("Content-Type", "image/svg+xml")
+	s := svg.New(w)
+	s.Start(size, size)
+	defer s.End()
+
+	if err := renderTree(s, parts, complexity, size, margin, false); err != nil {
+		fmt.Println("Error rendering tree: ", err)
+	}
+}
+
+// Each branch of a tree splits in two, so it has 2^(complexity+1) - 1 parts
+func treeParts(v Values) float64 {
+	return 2.0*powerOf(2, v.Int("complexity")) - 1.0
+}
+
+func pythagorasTreeEstimate(v Values) Estimate {
+	return polygonEstimate(treeParts(v), 4)
+}
+
+// The binary tree and h-tree are drawn as lines
+func branchEstimate(v Values) Estimate {
+	return lineEstimate(treeParts(v))
+}
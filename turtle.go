@@ -3,6 +3,7 @@ package main
 import (
 	"container/list"
 	"github.com/ajstarks/svgo"
+	"math"
 )
 
 // Holds the state of the turtle object
@@ -15,25 +16,58 @@ type turtleState struct {
 // The turtle object
 type Turtle struct {
 	turtleState
-	canvas *svg.SVG
-	stack  *list.List
+	canvas    *svg.SVG
+	stack     *list.List
+	transform *Matrix
 }
 
 // Create a new turtle object
 func NewTurtle(canvas *svg.SVG) *Turtle {
-	return &Turtle{canvas: canvas, stack: list.New(), turtleState: turtleState{location: Point{X: 0.0, Y: 0.0}, direction: Vector{Point{X: 1.0, Y: 0.0}}, penUp: false}}
+	return &Turtle{canvas: canvas, stack: list.New(), transform: NewMatrix(), turtleState: turtleState{location: Point{X: 0.0, Y: 0.0}, direction: Vector{Point{X: 1.0, Y: 0.0}}, penUp: false}}
 }
 
 // Move the turtle a total of distance units, also draws a line segment following that path if the pen is down
 func (t *Turtle) Move(distance float64) {
-	startX, startY := int(t.location.X), int(t.location.Y)
+	start := t.transform.Apply(t.location)
 	t.location.X += distance * t.direction.X
 	t.location.Y += distance * t.direction.Y
 	if !t.penUp {
-		t.canvas.Line(startX, startY, int(t.location.X), int(t.location.Y), "fill:none;stroke:black")
+		end := t.transform.Apply(t.location)
+		t.canvas.Line(int(start.X), int(start.Y), int(end.X), int(end.Y), "fill:none;stroke:black")
 	}
 }
 
+// Move to the point end of the turtle's own frame, in which it is at the origin heading
+// along the x axis, and turn to heading, also drawing a straight line there if draw is
+// set and the pen is down
+func (t *Turtle) Follow(end Point, heading Vector, draw bool) {
+	start := t.transform.Apply(t.location)
+	t.location = turtleFrame(t.location, t.direction, end)
+	t.direction = Vector{turtleFrame(Point{}, t.direction, heading.Point)}
+	if draw && !t.penUp {
+		end := t.transform.Apply(t.location)
+		t.canvas.Line(int(start.X), int(start.Y), int(end.X), int(end.Y), "fill:none;stroke:black")
+	}
+}
+
+// Return the bounding box on the canvas of points given in the turtle's own frame
+func (t *Turtle) CanvasBounds(points []Point) (low, high Point) {
+	for i, p := range points {
+		q := t.transform.Apply(turtleFrame(t.location, t.direction, p))
+		if i == 0 {
+			low, high = q, q
+		}
+		low.X, low.Y = math.Min(low.X, q.X), math.Min(low.Y, q.Y)
+		high.X, high.Y = math.Max(high.X, q.X), math.Max(high.Y, q.Y)
+	}
+	return low, high
+}
+
+// Set the transform used to place the turtle's drawing on the canvas
+func (t *Turtle) SetTransform(m *Matrix) {
+	t.transform = m
+}
+
 func (t *Turtle) PenUp() {
 	t.penUp = true
 }
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"math"
+)
+
+// The part of a curve's image drawn on the canvas.  The unzoomed image is magnified by
+// Zoom and placed on the canvas by a transform, normally so that a chosen point of it
+// is at the middle of the canvas.  Curves stop subdividing segments shorter than Detail
+// pixels, and skip the parts that fall outside the canvas.
+type Viewport struct {
+	Width, Height float64 // of the canvas
+	Zoom          float64
+	Detail        float64
+
+	view *Matrix
+	stop *RenderStop
+}
+
+// The deepest a zoom may take a recursion beyond its complexity, enough for a zoom of
+// 1e12 into a curve whose pieces shrink by a factor of sqrt(2) each level
+const maxZoomLevels = 100
+
+// Create the viewport given by the x, y, zoom and detail parameters for an image whose
+// unzoomed size is width x height.  When drawing a map tile it is the tile's viewport.
+// x and y are the point of the image, as fractions of its width and height, placed at
+// the middle of the canvas.
+func NewViewport(v Values, width, height int) *Viewport {
+	var vp *Viewport
+	if v.tile != nil {
+		vp = v.tile.Viewport(float64(width), float64(height), v.Float("detail"))
+	} else {
+		vp = &Viewport{Width: float64(width), Height: float64(height), Zoom: v.Float("zoom"), Detail: v.Float("detail"), view: NewMatrix()}
+		vp.view.Translate(vp.Width/2.0, vp.Height/2.0)
+		vp.view.Scale(vp.Zoom, vp.Zoom)
+		vp.view.Translate(-v.Float("x")*vp.Width, -v.Float("y")*vp.Height)
+	}
+	vp.stop = v.stop
+	return vp
+}
+
+// Count a step of drawing through the viewport, returning whether the render has been
+// stopped and should draw nothing more
+func (vp *Viewport) Stopped() bool {
+	return vp.stop.Stopped()
+}
+
+// Return the transform placing the unzoomed image on the canvas
+func (vp *Viewport) Matrix() *Matrix {
+	return vp.view.Copy()
+}
+
+// Return whether any of the box from low to high is on the canvas
+func (vp *Viewport) Visible(low, high Point) bool {
+	return high.X >= 0.0 && low.X <= vp.Width && high.Y >= 0.0 && low.Y <= vp.Height
+}
+
+// Return whether any of the disk is on the canvas
+func (vp *Viewport) VisibleDisk(center Point, radius float64) bool {
+	return vp.Visible(Point{X: center.X - radius, Y: center.Y - radius}, Point{X: center.X + radius, Y: center.Y + radius})
+}
+
+// Return whether any of the box around the line is on the canvas
+func (vp *Viewport) VisibleLine(l Line) bool {
+	end := l.At(1.0)
+	return vp.Visible(Point{X: math.Min(l.Start.X, end.X), Y: math.Min(l.Start.Y, end.Y)}, Point{X: math.Max(l.Start.X, end.X), Y: math.Max(l.Start.Y, end.Y)})
+}
+
+// Return how many more levels a recursion that shrinks its pieces by growth each
+// level needs for the zoomed image to show as much detail as the unzoomed one
+func (vp *Viewport) Levels(growth float64) int {
+	if vp.Zoom <= 1.0 || growth <= 1.0 {
+		return 0
+	}
+	return int(math.Min(math.Ceil(math.Log(vp.Zoom)/math.Log(growth)), maxZoomLevels))
+}
+
+// Mix the bits of x, using the finaliser of the splitmix64 generator
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// Return the id of the i'th child of a node of a recursion
+func childNode(node uint64, i int) uint64 {
+	return mix64(node + uint64(i+1)*0x9e3779b97f4a7c15)
+}
+
+// Return the k'th random number in [0, 1) belonging to a node of a recursion.
+// Unlike a sequence of random numbers these don't depend on which other nodes are
+// drawn, so a randomised curve looks the same however far it is zoomed.
+func nodeRandom(seed int64, node uint64, k int) float64 {
+	return float64(mix64(uint64(seed)^mix64(node+uint64(k)))>>11) / (1 << 53)
+}
+
+// Return the radius, as a fraction of a segment's length, of a disk about its
+// middle holding everything a recursion replacing it with children draws, and the
+// largest child's length as a fraction of the segment's.  The radius is infinite if
+// a child is as long as its parent.
+func subdivisionBound(parent Line, children []Line) (radius, ratio float64) {
+	length := math.Abs(parent.Length())
+	middle := parent.At(0.5)
+	radius = 0.5
+	for _, c := range children {
+		m := math.Abs(c.Length()) / length
+		ratio = math.Max(ratio, m)
+		mid := c.At(0.5)
+		offset := math.Hypot(mid.X-middle.X, mid.Y-middle.Y) / length
+		if m >= 1.0 {
+			radius = math.Inf(1)
+		} else {
+			radius = math.Max(radius, offset/(1.0-m))
+		}
+	}
+	return radius, ratio
+}